@@ -0,0 +1,100 @@
+package simpledb
+
+// A write batch groups puts and deletes so they are applied atomically: a
+// reader sees either none of a batch or all of it, and so does recovery.
+//
+// Apply installs the whole batch under one bufferL critical section, and logs
+// it as a single logOpBatch record whose value holds the batch's records. A
+// crash in the middle of appending the batch leaves a torn record, which
+// replay discards like any other.
+
+// A WriteBatch collects writes to apply together with Apply.
+//
+// The zero value is an empty batch. A WriteBatch is not safe for concurrent
+// use.
+type WriteBatch struct {
+	records []logRecord
+}
+
+// Put adds a write of k to v to the batch. Later writes to the same key in a
+// batch take precedence over earlier ones.
+func (b *WriteBatch) Put(k []byte, v []byte) {
+	// copy, since the caller may reuse k and v before Apply
+	v2 := make([]byte, len(v))
+	copy(v2, v)
+	b.records = append(b.records, logRecord{
+		Op:    logOpPut,
+		Key:   append([]byte{}, k...),
+		Value: v2,
+	})
+}
+
+// Delete adds a deletion of k to the batch.
+func (b *WriteBatch) Delete(k []byte) {
+	b.records = append(b.records, logRecord{
+		Op:    logOpDelete,
+		Key:   append([]byte{}, k...),
+		Value: nil,
+	})
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.records)
+}
+
+func encodeBatch(records []logRecord) []byte {
+	var p []byte
+	for _, r := range records {
+		p = encodeLogRecord(r, p)
+	}
+	return p
+}
+
+// decodeBatch returns the records of a batch, or false if it is malformed.
+func decodeBatch(data []byte) ([]logRecord, bool) {
+	var records []logRecord
+	for len(data) > 0 {
+		r, l := decodeLogRecord(data)
+		if l == 0 || r.Op == logOpBatch {
+			return nil, false
+		}
+		records = append(records, r)
+		data = data[l:]
+	}
+	return records, true
+}
+
+// applyRecords assigns sequence numbers to the writes in records, logs them
+// as one batch and adds them to the write buffer. Returns a ticket for
+// logWait.
+//
+// Assumes bufferL is held.
+func applyRecords(db *Database, records []logRecord) uint64 {
+	seqRecords := make([]logRecord, len(records))
+	for i, r := range records {
+		r.Seq = nextSeq(db)
+		seqRecords[i] = r
+	}
+	ticket := logAdd(db.log, logRecord{
+		Op: logOpBatch, Seq: 0, Key: nil, Value: encodeBatch(seqRecords),
+	})
+	for _, r := range seqRecords {
+		bufferWrite(db, string(r.Key), version{seq: r.Seq, value: r.Value})
+	}
+	return ticket
+}
+
+// Apply atomically applies all the writes in b to db.
+//
+// Like Write, Apply returns once the batch is in the log. An empty batch does
+// nothing. Errors are as for Write, and a failed batch is not applied at all
+// if the database is recovered.
+func Apply(db *Database, b *WriteBatch) error {
+	if len(b.records) == 0 {
+		return nil
+	}
+	return bufferedWrite(db, func() (uint64, bool, error) {
+		return applyRecords(db, b.records), true, nil
+	})
+}
@@ -0,0 +1,91 @@
+package simpledb
+
+import (
+	"sync"
+
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+func (suite *SimpleDbSuite) TestApplyBatch() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	var b WriteBatch
+	b.Put(key(2), []byte("v2"))
+	b.Put(key(3), []byte("v3"))
+	b.Delete(key(1))
+	b.Put(key(2), []byte("v2 again"))
+	suite.Equal(4, b.Len())
+	suite.NoError(Apply(db, &b))
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.Equal(present("v2 again"), dbRead(db, key(2)))
+	suite.Equal(present("v3"), dbRead(db, key(3)))
+	suite.NoError(Apply(db, &WriteBatch{}))
+}
+
+func (suite *SimpleDbSuite) TestApplyBatchCopies() {
+	db := mustDb(NewDb())
+	var b WriteBatch
+	k := key(1)
+	v := []byte("v1")
+	b.Put(k, v)
+	k[7] = 2
+	v[0] = 'x'
+	suite.NoError(Apply(db, &b))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(missing, dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestRecoverBatch() {
+	db := mustDb(NewDb())
+	var b WriteBatch
+	b.Put(key(1), []byte("v1"))
+	b.Put(key(2), nil)
+	suite.NoError(Apply(db, &b))
+	var b2 WriteBatch
+	b2.Delete(key(1))
+	b2.Put(key(3), []byte("v3"))
+	suite.NoError(Apply(db, &b2))
+	db = mustDb(Recover())
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.Equal(present(""), dbRead(db, key(2)))
+	suite.Equal(present("v3"), dbRead(db, key(3)))
+}
+
+func (suite *SimpleDbSuite) TestRecoverTornBatch() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	// simulate a crash in the middle of appending a batch
+	var b WriteBatch
+	b.Put(key(2), []byte("v2"))
+	b.Delete(key(1))
+	p := encodeLogRecord(logRecord{
+		Op: logOpBatch, Key: nil, Value: encodeBatch(b.records),
+	}, nil)
+	filesys.Append(db.log.file, p[:len(p)-2])
+	db = mustDb(Recover())
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(missing, dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestBatchAtomicForReaders() {
+	db := mustDb(NewDb())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		for i := 0; i < 100; i++ {
+			var b WriteBatch
+			b.Put(key(1), []byte{byte(i)})
+			b.Put(key(2), []byte{byte(i)})
+			suite.NoError(Apply(db, &b))
+		}
+		wg.Done()
+	}()
+	for i := 0; i < 100; i++ {
+		s := Snapshot(db)
+		v1 := suite.snapRead(s, key(1))
+		v2 := suite.snapRead(s, key(2))
+		suite.NoError(s.Close())
+		suite.Equal(v1, v2, "saw half of a batch")
+	}
+	wg.Wait()
+}
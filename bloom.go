@@ -0,0 +1,116 @@
+package simpledb
+
+import (
+	"hash/crc32"
+)
+
+// Each table has a Bloom filter over its keys, so that a read of a key the
+// table doesn't have can usually skip the table without reading a block.
+//
+//	filter := filterKind(u64) checksum(u64) len(u64) numProbes(u64) bits*
+//
+// The filter sits between the blocks and the index, and is checksummed like
+// a block. A key sets numProbes bits, chosen by double hashing; a read checks
+// those bits, and only goes on to the index and blocks if all of them are set.
+// With b bits per key (Options.BloomBitsPerKey), about 0.6^b of the reads of
+// missing keys get past the filter: 1% at the default of 10.
+//
+// A table written with no bits per key has no filter, and neither does a
+// table whose index had to be rebuilt (see scanTableIndex); every read then
+// goes to the blocks.
+
+// A bloomFilter is the encoded numProbes and bits of a filter, or nil for a
+// table without one.
+type bloomFilter []byte
+
+const filterKind = uint64(3)
+
+// bloomHash is a 64-bit FNV-1a hash of k
+func bloomHash(k []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, b := range k {
+		h = h ^ uint64(b)
+		h = h * 1099511628211
+	}
+	return h
+}
+
+// newBloomFilter builds a filter over the keys with hashes hashes, using
+// bitsPerKey bits for each one.
+func newBloomFilter(hashes []uint64, bitsPerKey uint64) bloomFilter {
+	// ln(2) * bitsPerKey probes minimizes the false positive rate
+	numProbes := bitsPerKey * 69 / 100
+	if numProbes < 1 {
+		numProbes = 1
+	}
+	if numProbes > 30 {
+		numProbes = 30
+	}
+	numBits := uint64(len(hashes)) * bitsPerKey
+	// very small filters have a high false positive rate
+	if numBits < 64 {
+		numBits = 64
+	}
+	numBytes := (numBits + 7) / 8
+	numBits = numBytes * 8
+	f := EncodeUInt64(numProbes, nil)
+	bits := make([]byte, numBytes)
+	for _, h := range hashes {
+		delta := h>>33 | h<<31
+		for i := uint64(0); i < numProbes; i++ {
+			bit := h % numBits
+			bits[bit/8] = bits[bit/8] | 1<<(bit%8)
+			h = h + delta
+		}
+	}
+	return append(f, bits...)
+}
+
+// bloomMayContain reports whether a key with hash h might be in the table
+// with filter f.
+func bloomMayContain(f bloomFilter, h uint64) bool {
+	if len(f) <= 8 {
+		return true
+	}
+	numProbes, _ := DecodeUInt64(f)
+	bits := f[8:]
+	numBits := uint64(len(bits)) * 8
+	delta := h>>33 | h<<31
+	for i := uint64(0); i < numProbes; i++ {
+		bit := h % numBits
+		if bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		h = h + delta
+	}
+	return true
+}
+
+func encodeFilter(f bloomFilter) []byte {
+	p := EncodeUInt64(filterKind, nil)
+	p = EncodeUInt64(uint64(crc32.Checksum(f, castagnoli)), p)
+	p = EncodeSlice(f, p)
+	return p
+}
+
+// decodeFilter is a Decoder(bloomFilter).
+//
+// Fails if the filter is truncated or its checksum doesn't match.
+func decodeFilter(data []byte) (bloomFilter, uint64) {
+	kind, l1 := DecodeUInt64(data)
+	if l1 == 0 || kind != filterKind {
+		return nil, 0
+	}
+	checksum, l2 := DecodeUInt64(data[l1:])
+	if l2 == 0 {
+		return nil, 0
+	}
+	f, l3 := decodeSlice(data[l1+l2:])
+	if l3 == 0 || len(f) < 8 {
+		return nil, 0
+	}
+	if uint64(crc32.Checksum(f, castagnoli)) != checksum {
+		return nil, 0
+	}
+	return bloomFilter(f), l1 + l2 + l3
+}
@@ -0,0 +1,105 @@
+package simpledb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+func TestBloomFilter(t *testing.T) {
+	assert := assert.New(t)
+	var hashes []uint64
+	for k := uint64(0); k < 1000; k++ {
+		hashes = append(hashes, bloomHash(key(2*k)))
+	}
+	f := newBloomFilter(hashes, 10)
+	falsePositives := 0
+	for k := uint64(0); k < 1000; k++ {
+		assert.True(bloomMayContain(f, bloomHash(key(2*k))))
+		if bloomMayContain(f, bloomHash(key(2*k+1))) {
+			falsePositives++
+		}
+	}
+	assert.True(falsePositives < 30,
+		"%d false positives out of 1000", falsePositives)
+	assert.True(bloomMayContain(nil, bloomHash(key(1))),
+		"no filter should pass every key")
+
+	decoded, l := decodeFilter(encodeFilter(f))
+	assert.Equal(f, decoded)
+	p := encodeFilter(f)
+	p[len(p)-1] ^= 1
+	_, l = decodeFilter(p)
+	assert.Equal(uint64(0), l, "bad checksum")
+}
+
+func (suite *SimpleDbSuite) TestTableBloomFilter() {
+	w, _ := newTableWriter(defaultDir(), "table",
+		tableOptions{bitsPerKey: 10})
+	for k := uint64(0); k < 1000; k++ {
+		tablePut(w, key(2*k), 2, []byte("value"))
+		tablePut(w, key(2*k), 1, []byte("old value"))
+	}
+	tmp, _ := tableWriterClose(w)
+	CloseTable(tmp)
+
+	t, _ := RecoverTable(filesys.Fs, "db", "table")
+	suite.Equal(tmp.Index, t.Index)
+	suite.Equal(tmp.filter, t.filter)
+	for k := uint64(0); k < 1000; k++ {
+		suite.Equal(present("value"), tblRead(t, key(2*k)))
+	}
+	// with the file closed, only reads the filter rules out succeed
+	CloseTable(t)
+	skipped := 0
+	for k := uint64(0); k < 1000; k++ {
+		_, ok, err := tableRead(nil, t, key(2*k+1), latestSeq)
+		suite.False(ok)
+		if err == nil {
+			skipped++
+		}
+	}
+	suite.True(skipped > 970, "only %d reads skipped the table", skipped)
+}
+
+func (suite *SimpleDbSuite) TestTableCorruptFilter() {
+	w, _ := newTableWriter(defaultDir(), "table",
+		tableOptions{bitsPerKey: 10})
+	for k := uint64(0); k < 100; k++ {
+		tablePut(w, key(k), 1, []byte("value"))
+	}
+	tmp, _ := tableWriterClose(w)
+	CloseTable(tmp)
+	data := readFile("table")
+	last := tmp.Index[len(tmp.Index)-1]
+	data[last.Offset+last.Length+30] ^= 1
+	writeFile("corrupt", data)
+
+	// the footer is rejected, so the table is read without a filter
+	t, _ := RecoverTable(filesys.Fs, "db", "corrupt")
+	suite.Nil(t.filter)
+	suite.Equal(tmp.Index, t.Index)
+	suite.Equal(present("value"), tblRead(t, key(50)))
+	suite.Equal(missing, tblRead(t, key(100)))
+	CloseTable(t)
+}
+
+func (suite *SimpleDbSuite) TestBloomBitsPerKey() {
+	opts := noCompactionOptions()
+	opts.BloomBitsPerKey = 0
+	db := mustDb(NewDbWithOptions(opts))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.Nil((*db.levels)[0][0].table.filter)
+	suite.NoError(Shutdown(db))
+
+	opts.BloomBitsPerKey = 20
+	db = mustDb(RecoverWithOptions(opts))
+	suite.NoError(Write(db, key(2), []byte("v2")))
+	suite.NoError(Compact(db))
+	suite.NotNil((*db.levels)[0][0].table.filter)
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(present("v2"), dbRead(db, key(2)))
+	suite.Equal(missing, dbRead(db, key(3)))
+}
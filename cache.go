@@ -0,0 +1,136 @@
+package simpledb
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// The block cache keeps recently read table blocks in memory, so that reads
+// of hot keys don't go to the filesystem.
+//
+// Blocks are cached after their checksum is verified, keyed by the table they
+// came from and their offset in it. Each Table opened gets a unique id for its
+// cache entries, which is cheaper to hash than its file name. Only point reads
+// go through the cache; iterators (including the ones merges use to copy
+// tables into the next level) would otherwise flush it on every scan.
+
+// lastTableID is the id of the most recently opened table
+var lastTableID uint64
+
+func newTableID() uint64 {
+	return atomic.AddUint64(&lastTableID, 1)
+}
+
+type blockCacheKey struct {
+	table  uint64
+	offset uint64
+}
+
+type blockCacheEntry struct {
+	key  blockCacheKey
+	data []byte
+}
+
+// A blockCache is an LRU cache of table blocks, bounded by the total size of
+// the blocks.
+type blockCache struct {
+	mu       *sync.Mutex
+	capacity uint64
+	size     uint64
+	// the most recently used entry is at the front
+	lru     *list.List
+	entries map[blockCacheKey]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+// newBlockCache creates a cache holding up to capacity bytes of blocks, or
+// returns nil (no cache) if capacity is 0.
+func newBlockCache(capacity uint64) *blockCache {
+	if capacity == 0 {
+		return nil
+	}
+	return &blockCache{
+		mu:       new(sync.Mutex),
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[blockCacheKey]*list.Element),
+	}
+}
+
+func blockCacheGet(c *blockCache, k blockCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[k]
+	if !ok {
+		c.misses = c.misses + 1
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.hits = c.hits + 1
+	c.lru.MoveToFront(e)
+	data := e.Value.(blockCacheEntry).data
+	c.mu.Unlock()
+	return data, true
+}
+
+func blockCacheRemove(c *blockCache, e *list.Element) {
+	entry := c.lru.Remove(e).(blockCacheEntry)
+	delete(c.entries, entry.key)
+	c.size = c.size - uint64(len(entry.data))
+}
+
+// blockCachePut adds a block to the cache, evicting the least recently used
+// blocks to make room.
+func blockCachePut(c *blockCache, k blockCacheKey, data []byte) {
+	if uint64(len(data)) > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	_, ok := c.entries[k]
+	if ok {
+		// another reader got here first
+		c.mu.Unlock()
+		return
+	}
+	for c.size+uint64(len(data)) > c.capacity {
+		blockCacheRemove(c, c.lru.Back())
+	}
+	c.entries[k] = c.lru.PushFront(blockCacheEntry{key: k, data: data})
+	c.size = c.size + uint64(len(data))
+	c.mu.Unlock()
+}
+
+// blockCacheEvictTable drops the blocks of a table that has been deleted.
+func blockCacheEvictTable(c *blockCache, table uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	for k, e := range c.entries {
+		if k.table == table {
+			blockCacheRemove(c, e)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// readCachedBlock reads the entries of block b of t, through c if it isn't
+// nil.
+func readCachedBlock(c *blockCache, t Table, b int) ([]byte, error) {
+	h := t.Index[b]
+	if c == nil {
+		return readBlockData(t, h)
+	}
+	k := blockCacheKey{table: t.id, offset: h.Offset}
+	data, ok := blockCacheGet(c, k)
+	if ok {
+		return data, nil
+	}
+	data, err := readBlockData(t, h)
+	if err != nil {
+		return nil, err
+	}
+	blockCachePut(c, k, data)
+	return data, nil
+}
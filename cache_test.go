@@ -0,0 +1,80 @@
+package simpledb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockCacheLRU(t *testing.T) {
+	assert := assert.New(t)
+	c := newBlockCache(100)
+	key := func(off uint64) blockCacheKey {
+		return blockCacheKey{table: 1, offset: off}
+	}
+	blockCachePut(c, key(0), make([]byte, 40))
+	blockCachePut(c, key(1), make([]byte, 40))
+	_, ok := blockCacheGet(c, key(0))
+	assert.True(ok)
+	// evicts 1, the least recently used
+	blockCachePut(c, key(2), make([]byte, 40))
+	_, ok = blockCacheGet(c, key(1))
+	assert.False(ok)
+	_, ok = blockCacheGet(c, key(0))
+	assert.True(ok)
+	assert.Equal(uint64(80), c.size)
+
+	// too big to cache
+	blockCachePut(c, key(3), make([]byte, 101))
+	_, ok = blockCacheGet(c, key(3))
+	assert.False(ok)
+	assert.Equal(uint64(2), c.hits)
+	assert.Equal(uint64(2), c.misses)
+
+	blockCachePut(c, blockCacheKey{table: 2, offset: 0}, make([]byte, 10))
+	blockCacheEvictTable(c, 1)
+	assert.Equal(1, len(c.entries))
+	assert.Equal(uint64(10), c.size)
+}
+
+func (suite *SimpleDbSuite) TestBlockCache() {
+	opts := noCompactionOptions()
+	opts.ReadBuffer = ClearReadBuffer
+	db := mustDb(NewDbWithOptions(opts))
+	for k := uint64(0); k < 1000; k++ {
+		suite.NoError(Write(db, key(k), []byte("value")))
+	}
+	suite.NoError(Compact(db))
+	suite.Equal(present("value"), dbRead(db, key(1)))
+	stats := GetStats(db)
+	suite.Equal(uint64(0), stats.BlockCacheHits)
+	suite.Equal(uint64(1), stats.BlockCacheMisses)
+
+	// the second read of the same block is cached
+	v, _, _ := Read(db, key(2))
+	v[0] = 'V'
+	suite.Equal(present("value"), dbRead(db, key(2)),
+		"callers can't modify the cached block")
+	suite.Equal(uint64(2), GetStats(db).BlockCacheHits)
+
+	// the old table's blocks are dropped when it's merged away
+	oldTable := (*db.levels)[0][0].table
+	suite.NoError(Write(db, key(1), []byte("new value")))
+	suite.NoError(CompactAll(db))
+	for k := range db.cache.entries {
+		suite.NotEqual(oldTable.id, k.table)
+	}
+	suite.Equal(present("new value"), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestBlockCacheDisabled() {
+	opts := noCompactionOptions()
+	opts.ReadBuffer = ClearReadBuffer
+	opts.BlockCacheBytes = 0
+	db := mustDb(NewDbWithOptions(opts))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(uint64(0), GetStats(db).BlockCacheMisses)
+}
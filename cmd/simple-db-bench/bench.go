@@ -1,39 +1,77 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"math/rand"
 	"os"
 	"time"
 
 	"github.com/tchajed/go-simple-db"
-	"github.com/tchajed/goose/machine/filesys"
 )
 
+const valueSize = 100
+
 type gen struct {
 	rand    []*rand.Rand
 	maxKeys int
+	// values are taken from here
+	values []byte
+}
+
+// compressibleData generates n bytes in which each value is a random prefix
+// that makes up a fraction compressibility of it, repeated to fill the value.
+func compressibleData(r *rand.Rand, n int, compressibility float64) []byte {
+	random := int(valueSize * compressibility)
+	if random < 1 {
+		random = 1
+	}
+	data := make([]byte, 0, n)
+	for len(data) < n {
+		piece := make([]byte, random)
+		for i := range piece {
+			piece[i] = byte(' ' + r.Intn(95))
+		}
+		for i := 0; i < valueSize; i++ {
+			data = append(data, piece[i%random])
+		}
+	}
+	return data
 }
 
-func newGen(par int, maxKeys int) gen {
+func newGen(par int, maxKeys int, compressibility float64) gen {
 	generators := make([]*rand.Rand, par)
 	for i := range generators {
 		seed := int64(i)
 		generators[i] = rand.New(rand.NewSource(seed))
 	}
+	values := compressibleData(rand.New(rand.NewSource(-1)), 1<<20,
+		compressibility)
 	return gen{
 		rand:    generators,
 		maxKeys: maxKeys,
+		values:  values,
 	}
 }
 
-func (g gen) RandomKey(tid int) uint64 {
+// encodeKey turns key number n into a database key
+func encodeKey(n uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, n)
+	return k
+}
+
+func (g gen) RandomKey(tid int) []byte {
 	n := g.rand[tid].Int63n(int64(g.maxKeys))
-	return uint64(n)
+	return encodeKey(uint64(n))
 }
 
-func (g gen) Value() []byte {
-	return make([]byte, 100)
+// Value returns a value to write to k
+func (g gen) Value(k []byte) []byte {
+	n := binary.BigEndian.Uint64(k) % uint64(len(g.values)/valueSize)
+	v := make([]byte, valueSize)
+	copy(v, g.values[n*valueSize:])
+	return v
 }
 
 type stats struct {
@@ -110,7 +148,7 @@ func (s stats) formatStats() string {
 		s.MegabytesPerSec())
 }
 
-func prepareDb(dir string) simpledb.Database {
+func prepareDb(dir string, opts simpledb.Options) *simpledb.Database {
 	err := os.Mkdir(dir, 0744)
 	if os.IsExist(err) {
 		_ = os.RemoveAll(dir)
@@ -119,15 +157,21 @@ func prepareDb(dir string) simpledb.Database {
 	if err != nil {
 		panic(err)
 	}
-	fs := filesys.NewDirFs(dir)
+	fs := simpledb.NewSyncDirFs(dir)
 	fs.Mkdir("db")
-	filesys.Fs = fs
-	return simpledb.NewDb()
+	db, err := simpledb.Open(fs, "db", opts)
+	if err != nil {
+		panic(err)
+	}
+	return db
 }
 
-func shutdownDb(db simpledb.Database, dir string) {
-	simpledb.Shutdown(db)
-	err := os.RemoveAll(dir)
+func shutdownDb(db *simpledb.Database, dir string) {
+	err := simpledb.Shutdown(db)
+	if err != nil {
+		panic(err)
+	}
+	err = os.RemoveAll(dir)
 	if err != nil {
 		panic(err)
 	}
@@ -138,12 +182,12 @@ type bencher struct {
 	conf config
 	stats
 	gen
-	db simpledb.Database
+	db *simpledb.Database
 }
 
 func newBench(conf config, name string, par int) bencher {
-	db := prepareDb(conf.DatabaseDir)
-	gen := newGen(par, conf.DatabaseSize)
+	db := prepareDb(conf.DatabaseDir, conf.Options)
+	gen := newGen(par, conf.DatabaseSize, conf.ValueCompressibility)
 	return bencher{
 		name:  name,
 		conf:  conf,
@@ -174,16 +218,22 @@ func (b *bencher) IsFinished() bool {
 
 // Read a random key. Returns the bytes of data read.
 func (b *bencher) Read(tid int) int {
-	v, ok := simpledb.Read(b.db, b.RandomKey(tid))
+	v, ok, err := simpledb.Read(b.db, b.RandomKey(tid))
+	if err != nil {
+		panic(err)
+	}
 	if !ok {
 		return 0
 	}
 	return len(v)
 }
 
-func (b *bencher) writeKey(k uint64) int {
-	v := b.Value()
-	simpledb.Write(b.db, k, v)
+func (b *bencher) writeKey(k []byte) int {
+	v := b.Value(k)
+	err := simpledb.Write(b.db, k, v)
+	if err != nil {
+		panic(err)
+	}
 	return len(v)
 }
 
@@ -194,10 +244,32 @@ func (b *bencher) Write(tid int) int {
 
 func (b *bencher) Fill() {
 	for k := 0; k < b.maxKeys; k++ {
-		b.writeKey(uint64(k))
+		b.writeKey(encodeKey(uint64(k)))
 	}
 }
 
+// Compactions returns the number of compactions so far
+func (b *bencher) Compactions() uint64 {
+	return simpledb.GetStats(b.db).Compactions
+}
+
+// printStalls reports the time writes spent stalled
+func (b *bencher) printStalls() {
+	s := simpledb.GetStats(b.db)
+	fmt.Printf("  stalled %d writes for %v, stopped %d writes for %v\n",
+		s.WriteSlowdowns, s.WriteSlowdownTime, s.WriteStops, s.WriteStopTime)
+}
+
+// printCacheStats reports how well the block cache worked
+func (b *bencher) printCacheStats() {
+	s := simpledb.GetStats(b.db)
+	fmt.Printf("  block cache: %d hits, %d misses\n",
+		s.BlockCacheHits, s.BlockCacheMisses)
+}
+
 func (b *bencher) Compact() {
-	simpledb.Compact(b.db)
+	err := simpledb.Compact(b.db)
+	if err != nil {
+		panic(err)
+	}
 }
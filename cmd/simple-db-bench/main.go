@@ -8,6 +8,8 @@ import (
 	"regexp"
 	"runtime"
 	"runtime/pprof"
+
+	"github.com/tchajed/go-simple-db"
 )
 
 type config struct {
@@ -15,6 +17,9 @@ type config struct {
 	DatabaseSize int
 	BenchFilter  *regexp.Regexp
 	ListBenches  bool
+	// ValueCompressibility is the fraction of each value that is random
+	ValueCompressibility float64
+	Options              simpledb.Options
 }
 
 func (conf config) runBench(name string, par int, f func(b *bencher)) {
@@ -33,27 +38,42 @@ func (conf config) runBench(name string, par int, f func(b *bencher)) {
 	b.stop()
 }
 
-// startCompaction starts running compactions continuously
-//
-// startCompaction returns a channel. To stop compaction,
-// read from this channel; after the current compaction finishes,
-// the read will return the number of compactions completed and no more will
-// run.
-func startCompaction(b *bencher) (done chan int) {
-	done = make(chan int)
-	numCompactions := 0
-	go func() {
-		for {
-			select {
-			case done <- numCompactions:
-				return
-			default:
-				b.Compact()
-				numCompactions++
-			}
-		}
-	}()
-	return done
+func parseSyncPolicy(s string) (simpledb.SyncPolicy, error) {
+	switch s {
+	case "always":
+		return simpledb.SyncAlways, nil
+	case "periodic":
+		return simpledb.SyncPeriodic, nil
+	case "never":
+		return simpledb.SyncNever, nil
+	}
+	return 0, fmt.Errorf("unknown sync policy %s", s)
+}
+
+func parseReadBufferPolicy(s string) (simpledb.ReadBufferPolicy, error) {
+	switch s {
+	case "keep":
+		return simpledb.KeepReadBuffer, nil
+	case "clear":
+		return simpledb.ClearReadBuffer, nil
+	case "bound":
+		return simpledb.BoundReadBuffer, nil
+	}
+	return 0, fmt.Errorf("unknown read buffer policy %s", s)
+}
+
+func parseCompression(s string) (simpledb.Compression, error) {
+	switch s {
+	case "none":
+		return simpledb.NoCompression, nil
+	case "flate":
+		return simpledb.FlateCompression, nil
+	case "gzip":
+		return simpledb.GzipCompression, nil
+	case "zlib":
+		return simpledb.ZlibCompression, nil
+	}
+	return 0, fmt.Errorf("unknown codec %s", s)
 }
 
 func writeMemProfile(fname string) {
@@ -88,8 +108,55 @@ func main() {
 		"write cpu profile to `file`")
 	var memprofile = flag.String("memprofile", "",
 		"write memory cpu profile to `file`")
+	conf.Options = simpledb.DefaultOptions()
+	syncString := flag.String("sync", "never",
+		"log sync policy (always, periodic, or never)")
+	flag.DurationVar(&conf.Options.SyncInterval, "sync-interval",
+		conf.Options.SyncInterval,
+		"time between log syncs for -sync=periodic")
+	flag.Uint64Var(&conf.Options.CompactBufferBytes, "compact-bytes",
+		conf.Options.CompactBufferBytes,
+		"buffered bytes that trigger a background compaction (0 for no limit)")
+	flag.Uint64Var(&conf.Options.CompactBufferKeys, "compact-keys",
+		conf.Options.CompactBufferKeys,
+		"buffered keys that trigger a background compaction (0 for no limit)")
+	flag.Uint64Var(&conf.Options.BufferSoftLimit, "buffer-soft-limit",
+		conf.Options.BufferSoftLimit,
+		"buffer bytes at which writes slow down (0 for no limit)")
+	flag.Uint64Var(&conf.Options.BufferHardLimit, "buffer-hard-limit",
+		conf.Options.BufferHardLimit,
+		"buffer bytes at which writes wait for compaction (0 for no limit)")
+	flag.Uint64Var(&conf.Options.BlockCacheBytes, "block-cache",
+		conf.Options.BlockCacheBytes,
+		"size of the table block cache in bytes (0 to disable)")
+	flag.Uint64Var(&conf.Options.BloomBitsPerKey, "bloom-bits",
+		conf.Options.BloomBitsPerKey,
+		"Bloom filter bits per key in new tables (0 to disable)")
+	codecString := flag.String("codec", "none",
+		"table block compression (none, flate, gzip, or zlib)")
+	flag.Float64Var(&conf.ValueCompressibility, "compressibility", 0.5,
+		"fraction of each value that is random, about what values compress to")
+	rbufferString := flag.String("rbuffer", "keep",
+		"read buffer policy after compaction (keep, clear, or bound)")
+	flag.Uint64Var(&conf.Options.ReadBufferBytes, "rbuffer-bytes",
+		conf.Options.ReadBufferBytes,
+		"read buffer size for -rbuffer=bound")
 	flag.Parse()
 
+	policy, err := parseSyncPolicy(*syncString)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf.Options.Sync = policy
+	conf.Options.ReadBuffer, err = parseReadBufferPolicy(*rbufferString)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf.Options.Compression, err = parseCompression(*codecString)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if filterString == nil || *filterString == "" {
 		conf.BenchFilter = regexp.MustCompile(".*")
 	} else {
@@ -122,16 +189,44 @@ func main() {
 		b.Compact()
 	})
 
-	conf.runBench("write + compact", 1, func(b *bencher) {
+	// concurrent writers share log syncs, so this benchmark always syncs;
+	// the writes are split among the threads to keep the number of syncs
+	// manageable
+	syncConf := conf
+	syncConf.Options.Sync = simpledb.SyncAlways
+	syncConf.runBench(fmt.Sprintf("writes + group commit (par=%d)", par),
+		par,
+		func(b *bencher) {
+			done := make(chan bool)
+			for tid := 0; tid < par; tid++ {
+				go func(tid int) {
+					for i := 0; i < 1000*kiters/par; i++ {
+						b.finishOp(tid, b.Write(tid))
+					}
+					done <- true
+				}(tid)
+			}
+			for tid := 0; tid < par; tid++ {
+				<-done
+			}
+		})
+
+	// these benchmarks compact in the background whenever a tenth of the
+	// database is buffered
+	compactConf := conf
+	compactConf.Options.CompactBufferKeys = uint64(conf.DatabaseSize / 10)
+
+	compactConf.runBench("write + compact", 1, func(b *bencher) {
 		b.Fill()
 		b.Reset()
-		stopCompaction := startCompaction(b)
+		startCompactions := b.Compactions()
 		for i := 0; i < 1000*kiters; i++ {
 			b.finishOp(0, b.Write(0))
 		}
 		b.finish()
-		numCompactions := <-stopCompaction
-		fmt.Printf("  finished %d compactions\n", numCompactions)
+		fmt.Printf("  finished %d compactions\n",
+			b.Compactions()-startCompactions)
+		b.printStalls()
 	})
 
 	conf.runBench("rbuf reads", 1, func(b *bencher) {
@@ -149,6 +244,8 @@ func main() {
 		for i := 0; i < 1000*kiters; i++ {
 			b.finishOp(0, b.Read(0))
 		}
+		b.finish()
+		b.printCacheStats()
 	})
 
 	conf.runBench(fmt.Sprintf("table reads (par=%d)", par),
@@ -192,13 +289,27 @@ func main() {
 			}
 		})
 
-	conf.runBench(fmt.Sprintf("read par=%d + compact", par),
+	// a writer keeps the background compactions going while the readers run
+	compactConf.runBench(fmt.Sprintf("read par=%d + write + compact", par),
 		par,
 		func(b *bencher) {
 			b.Fill()
 			b.Compact()
 			b.Reset()
-			stopCompaction := startCompaction(b)
+			startCompactions := b.Compactions()
+			stopWriter := make(chan bool)
+			writerDone := make(chan bool)
+			go func() {
+				for i := 0; ; i++ {
+					select {
+					case <-stopWriter:
+						writerDone <- true
+						return
+					default:
+						b.writeKey(encodeKey(uint64(i % b.maxKeys)))
+					}
+				}
+			}()
 			done := make(chan bool)
 			for tid := 0; tid < par; tid++ {
 				go func(tid int) {
@@ -212,7 +323,9 @@ func main() {
 				<-done
 			}
 			b.finish()
-			numCompactions := <-stopCompaction
-			fmt.Printf("  finished %d compactions\n", numCompactions)
+			stopWriter <- true
+			<-writerDone
+			fmt.Printf("  finished %d compactions\n",
+				b.Compactions()-startCompactions)
 		})
 }
@@ -0,0 +1,208 @@
+package simpledb
+
+import (
+	"sync"
+)
+
+// Background compaction keeps the write buffer from growing without bound.
+//
+// Writes that push the buffer past Options.CompactBufferBytes or
+// Options.CompactBufferKeys wake up a goroutine that calls Compact. The
+// trigger is a channel with room for one pending request, so a burst of
+// writes past the limit starts only one compaction, and writers never block
+// on it.
+
+// A compactor runs compactions in the background.
+type compactor struct {
+	maxBytes uint64
+	maxKeys  uint64
+	trigger  chan bool
+	stop     chan bool
+	stopped  chan bool
+
+	// protects err
+	mu *sync.Mutex
+	// the failure of the last background compaction, or nil if it succeeded
+	err error
+}
+
+// entrySize is the number of bytes a buffered write counts against
+// Options.CompactBufferBytes
+func entrySize(k string, v []byte) uint64 {
+	return uint64(len(k)) + uint64(len(v))
+}
+
+// versionsSize is the total entrySize of the buffered versions of k
+func versionsSize(k string, versions []version) uint64 {
+	n := uint64(0)
+	for _, v := range versions {
+		n = n + entrySize(k, v.value)
+	}
+	return n
+}
+
+func bufferSize(buf map[string][]version) uint64 {
+	n := uint64(0)
+	for k, versions := range buf {
+		n = n + versionsSize(k, versions)
+	}
+	return n
+}
+
+// bufferWrite adds a version of k to the write buffer, dropping older
+// versions no snapshot can see and keeping track of its size.
+//
+// Assumes bufferL is held.
+func bufferWrite(db *Database, k string, v version) {
+	buf := *db.wbuffer
+	old := buf[k]
+	*db.wbufferBytes = *db.wbufferBytes - versionsSize(k, old)
+	versions := liveVersions(append(old, v), liveSnapshots(db))
+	buf[k] = versions
+	*db.wbufferBytes = *db.wbufferBytes + versionsSize(k, versions)
+}
+
+// bufferFull reports whether the write buffer is past the compaction
+// threshold.
+//
+// Assumes bufferL is held.
+func bufferFull(db *Database) bool {
+	c := db.compactor
+	if c == nil {
+		return false
+	}
+	if c.maxBytes > 0 && *db.wbufferBytes >= c.maxBytes {
+		return true
+	}
+	if c.maxKeys > 0 && uint64(len(*db.wbuffer)) >= c.maxKeys {
+		return true
+	}
+	return false
+}
+
+// startCompactor starts compacting db in the background, if opts sets a
+// threshold.
+func startCompactor(db *Database, opts Options) {
+	if opts.CompactBufferBytes == 0 && opts.CompactBufferKeys == 0 {
+		return
+	}
+	c := &compactor{
+		maxBytes: opts.CompactBufferBytes,
+		maxKeys:  opts.CompactBufferKeys,
+		trigger:  make(chan bool, 1),
+		stop:     make(chan bool),
+		stopped:  make(chan bool),
+		mu:       new(sync.Mutex),
+	}
+	db.compactor = c
+	go compactInBackground(db, c)
+	// recovery can replay a full buffer
+	db.bufferL.RLock()
+	full := bufferFull(db)
+	db.bufferL.RUnlock()
+	if full {
+		compactSoon(c)
+	}
+}
+
+// compactSoon asks the compactor (if any) to run, unless a compaction is
+// already pending.
+func compactSoon(c *compactor) {
+	if c == nil {
+		return
+	}
+	select {
+	case c.trigger <- true:
+	default:
+	}
+}
+
+func compactInBackground(db *Database, c *compactor) {
+	for {
+		select {
+		case <-c.stop:
+			c.stopped <- true
+			return
+		case <-c.trigger:
+			// a compaction since the trigger may have emptied the buffer
+			db.bufferL.RLock()
+			full := bufferFull(db) || writesStalled(db)
+			db.bufferL.RUnlock()
+			if !full {
+				continue
+			}
+			err := Compact(db)
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+		}
+	}
+}
+
+// stopCompactor waits for any running background compaction and stops the
+// compactor, returning the error from the last background compaction.
+func stopCompactor(c *compactor) error {
+	if c == nil {
+		return nil
+	}
+	c.stop <- true
+	<-c.stopped
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	return err
+}
+
+// shrinkReadBuffer evicts entries from the read buffer until it takes up at
+// most limit bytes.
+//
+// Which entries are kept is unspecified. This is only safe once the read
+// buffer's contents are in the table.
+//
+// Assumes bufferL is held.
+func shrinkReadBuffer(db *Database, limit uint64) {
+	rbuf := *db.rbuffer
+	for k, versions := range rbuf {
+		if *db.rbufferBytes <= limit {
+			break
+		}
+		delete(rbuf, k)
+		*db.rbufferBytes = *db.rbufferBytes - versionsSize(k, versions)
+	}
+}
+
+// dropReadBufferOperands removes the keys with merge operands from the read
+// buffer once a compaction has installed its table: the table has the
+// operands folded into values, so resolving them again would apply them
+// twice.
+//
+// Assumes bufferL is held.
+func dropReadBufferOperands(db *Database) {
+	rbuf := *db.rbuffer
+	for k, versions := range rbuf {
+		for _, v := range versions {
+			if v.merge {
+				delete(rbuf, k)
+				*db.rbufferBytes = *db.rbufferBytes - versionsSize(k, versions)
+				break
+			}
+		}
+	}
+}
+
+// trimReadBuffer applies the read buffer policy after a compaction.
+//
+// Assumes bufferL is held.
+func trimReadBuffer(db *Database) {
+	if writesStalled(db) {
+		// give the memory to stalled writers
+		shrinkReadBuffer(db, 0)
+		return
+	}
+	if db.rbufferPolicy == ClearReadBuffer {
+		shrinkReadBuffer(db, 0)
+	}
+	if db.rbufferPolicy == BoundReadBuffer {
+		shrinkReadBuffer(db, db.rbufferLimit)
+	}
+}
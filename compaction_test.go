@@ -0,0 +1,121 @@
+package simpledb
+
+import (
+	"time"
+)
+
+// waitForCompactions waits until db has finished n compactions
+func (suite *SimpleDbSuite) waitForCompactions(db *Database, n uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for GetStats(db).Compactions < n {
+		if time.Now().After(deadline) {
+			suite.FailNow("timed out waiting for compaction",
+				"finished %d of %d", GetStats(db).Compactions, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (suite *SimpleDbSuite) TestBackgroundCompactionKeys() {
+	opts := DefaultOptions()
+	opts.CompactBufferKeys = 10
+	db := mustDb(NewDbWithOptions(opts))
+	for k := uint64(0); k < 9; k++ {
+		suite.NoError(Write(db, key(k), []byte("v")))
+	}
+	suite.NoError(Write(db, key(0), []byte("v")))
+	suite.Equal(uint64(0), GetStats(db).Compactions,
+		"overwrites shouldn't count against the limit")
+	suite.NoError(Write(db, key(9), []byte("v")))
+	suite.waitForCompactions(db, 1)
+	for k := uint64(0); k < 10; k++ {
+		suite.Equal(present("v"), dbRead(db, key(k)))
+	}
+	suite.NoError(Shutdown(db))
+
+	db = mustDb(RecoverWithOptions(opts))
+	for k := uint64(0); k < 10; k++ {
+		suite.Equal(present("v"), dbRead(db, key(k)))
+	}
+}
+
+func (suite *SimpleDbSuite) TestBackgroundCompactionBytes() {
+	opts := DefaultOptions()
+	opts.CompactBufferBytes = 10000
+	db := mustDb(NewDbWithOptions(opts))
+	for k := uint64(0); k < 100; k++ {
+		suite.NoError(Write(db, key(k), make([]byte, 1000)))
+	}
+	suite.waitForCompactions(db, 1)
+	db.bufferL.RLock()
+	suite.Equal(bufferSize(*db.wbuffer), *db.wbufferBytes)
+	db.bufferL.RUnlock()
+	suite.NoError(Close(db))
+}
+
+func (suite *SimpleDbSuite) TestBackgroundCompactionDisabled() {
+	opts := DefaultOptions()
+	opts.CompactBufferBytes = 0
+	opts.CompactBufferKeys = 0
+	db := mustDb(NewDbWithOptions(opts))
+	suite.Nil(db.compactor)
+	for k := uint64(0); k < 100; k++ {
+		suite.NoError(Write(db, key(k), make([]byte, 1000)))
+	}
+	suite.Equal(uint64(0), GetStats(db).Compactions)
+	suite.NoError(Close(db))
+	suite.Equal(uint64(1), GetStats(db).Compactions)
+}
+
+func (suite *SimpleDbSuite) TestRecoverFullBuffer() {
+	opts := DefaultOptions()
+	opts.CompactBufferKeys = 0
+	db := mustDb(NewDbWithOptions(opts))
+	for k := uint64(0); k < 20; k++ {
+		suite.NoError(Write(db, key(k), []byte("v")))
+	}
+	suite.NoError(Shutdown(db))
+
+	opts.CompactBufferKeys = 10
+	db = mustDb(RecoverWithOptions(opts))
+	suite.waitForCompactions(db, 1)
+	suite.Equal(present("v"), dbRead(db, key(19)))
+	suite.NoError(Shutdown(db))
+}
+
+func (suite *SimpleDbSuite) readBufferAfterCompact(
+	policy ReadBufferPolicy, limit uint64) *Database {
+	opts := noCompactionOptions()
+	opts.ReadBuffer = policy
+	opts.ReadBufferBytes = limit
+	db := mustDb(NewDbWithOptions(opts))
+	for k := uint64(0); k < 100; k++ {
+		suite.NoError(Write(db, key(k), make([]byte, 100)))
+	}
+	suite.NoError(Delete(db, key(0)))
+	suite.NoError(Compact(db))
+	for k := uint64(1); k < 100; k++ {
+		suite.Equal(bytesPresent(make([]byte, 100)), dbRead(db, key(k)))
+	}
+	suite.Equal(missing, dbRead(db, key(0)))
+	db.bufferL.RLock()
+	defer db.bufferL.RUnlock()
+	suite.Equal(bufferSize(*db.rbuffer), *db.rbufferBytes)
+	return db
+}
+
+func (suite *SimpleDbSuite) TestKeepReadBuffer() {
+	db := suite.readBufferAfterCompact(KeepReadBuffer, 0)
+	suite.Equal(100, len(*db.rbuffer))
+}
+
+func (suite *SimpleDbSuite) TestClearReadBuffer() {
+	db := suite.readBufferAfterCompact(ClearReadBuffer, 0)
+	suite.Equal(0, len(*db.rbuffer))
+}
+
+func (suite *SimpleDbSuite) TestBoundReadBuffer() {
+	db := suite.readBufferAfterCompact(BoundReadBuffer, 1000)
+	suite.True(*db.rbufferBytes <= 1000)
+	suite.True(len(*db.rbuffer) >= 9, "the cache should be filled")
+}
@@ -0,0 +1,83 @@
+package simpledb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+)
+
+// Compression is the codec used to compress table blocks.
+//
+// A table records its codec in its header, so tables written with different
+// codecs can be read side by side, and changing Options.Compression only
+// affects new tables. A block is stored uncompressed if compressing it doesn't
+// save at least an eighth of its size.
+type Compression int
+
+const (
+	// NoCompression stores blocks as is.
+	NoCompression Compression = iota
+	// FlateCompression compresses blocks with raw DEFLATE.
+	FlateCompression
+	// GzipCompression compresses blocks in the gzip format, which adds a
+	// header and CRC-32 to DEFLATE.
+	GzipCompression
+	// ZlibCompression compresses blocks in the zlib format, which adds a
+	// header and Adler-32 checksum to DEFLATE.
+	ZlibCompression
+)
+
+// validCompression reports whether codec is a known codec
+func validCompression(codec Compression) bool {
+	return codec >= NoCompression && codec <= ZlibCompression
+}
+
+// compressBlock compresses the encoded entries of a block with codec
+func compressBlock(codec Compression, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch codec {
+	case FlateCompression:
+		// only fails for an invalid level
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case GzipCompression:
+		w = gzip.NewWriter(&buf)
+	case ZlibCompression:
+		w = zlib.NewWriter(&buf)
+	default:
+		panic("compressBlock: no codec")
+	}
+	// writes to a bytes.Buffer don't fail
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// decompressBlock reverses compressBlock. Returns ErrCorrupt if data can't be
+// decompressed.
+func decompressBlock(codec Compression, data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch codec {
+	case FlateCompression:
+		r = flate.NewReader(bytes.NewReader(data))
+	case GzipCompression:
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case ZlibCompression:
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return nil, ErrCorrupt
+	}
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	p, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return p, nil
+}
@@ -0,0 +1,147 @@
+package simpledb
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+var codecs = []Compression{FlateCompression, GzipCompression, ZlibCompression}
+
+func TestCompressBlock(t *testing.T) {
+	assert := assert.New(t)
+	data := bytes.Repeat([]byte("{\"key\": \"value\"} "), 100)
+	for _, codec := range codecs {
+		compressed := compressBlock(codec, data)
+		assert.True(len(compressed) < len(data)/5, "codec %d", codec)
+		p, err := decompressBlock(codec, compressed)
+		assert.NoError(err)
+		assert.Equal(data, p)
+
+		_, err = decompressBlock(codec, compressed[:len(compressed)/2])
+		assert.Equal(ErrCorrupt, err, "codec %d: truncated", codec)
+	}
+	_, err := decompressBlock(NoCompression, data)
+	assert.Equal(ErrCorrupt, err)
+}
+
+// jsonValue is a compressible value for key n
+func jsonValue(n uint64) []byte {
+	return []byte("{\"id\": " + string(key(n)) +
+		", \"name\": \"some name\", \"tags\": [\"a\", \"b\", \"c\"]}")
+}
+
+func (suite *SimpleDbSuite) TestCompressedTable() {
+	w, _ := newTableWriter(defaultDir(), "raw", tableOptions{})
+	for k := uint64(0); k < 1000; k++ {
+		tablePut(w, key(k), 1, jsonValue(k))
+	}
+	raw, _ := tableWriterClose(w)
+	CloseTable(raw)
+	rawSize := len(readFile("raw"))
+
+	for _, codec := range codecs {
+		w, _ := newTableWriter(defaultDir(), "table",
+			tableOptions{bitsPerKey: 10, codec: codec})
+		for k := uint64(0); k < 1000; k++ {
+			tablePut(w, key(k), 1, jsonValue(k))
+		}
+		tmp, _ := tableWriterClose(w)
+		CloseTable(tmp)
+		data := readFile("table")
+		suite.True(len(data) < rawSize/2,
+			"codec %d: %d bytes compressed, %d raw", codec, len(data), rawSize)
+
+		t, err := RecoverTable(filesys.Fs, "db", "table")
+		suite.Require().NoError(err)
+		suite.Equal(codec, t.codec)
+		suite.Equal(tmp.Index, t.Index)
+		suite.Equal(bytesPresent(jsonValue(500)), tblRead(t, key(500)))
+		suite.Equal(missing, tblRead(t, key(1000)))
+		it := newTableIter(t)
+		tableIterSeek(it, nil)
+		n := 0
+		for ; tableIterValid(it); tableIterNext(it) {
+			suite.Equal(jsonValue(uint64(n)), tableIterEntry(it).Value)
+			n++
+		}
+		suite.NoError(tableIterErr(it))
+		suite.Equal(1000, n)
+		CloseTable(t)
+
+		// the index can still be rebuilt from compressed blocks
+		writeFile("no trailer", data[:len(data)-int(trailerSize)])
+		t, _ = RecoverTable(filesys.Fs, "db", "no trailer")
+		suite.Equal(tmp.Index, t.Index)
+		suite.Equal(bytesPresent(jsonValue(999)), tblRead(t, key(999)))
+		CloseTable(t)
+		filesys.Delete("db", "table")
+		filesys.Delete("db", "no trailer")
+	}
+}
+
+func (suite *SimpleDbSuite) TestIncompressibleBlocks() {
+	r := rand.New(rand.NewSource(1))
+	value := make([]byte, 1000)
+	w, _ := newTableWriter(defaultDir(), "table",
+		tableOptions{codec: GzipCompression})
+	for k := uint64(0); k < 100; k++ {
+		r.Read(value)
+		tablePut(w, key(k), 1, value)
+	}
+	t, _ := tableWriterClose(w)
+	p, _ := fsReadAt(t.dir, t.File, t.Index[0].Offset, 8)
+	kind, _ := DecodeUInt64(p)
+	suite.Equal(blockKind, kind, "random data should be stored as is")
+	suite.Equal(bytesPresent(value), tblRead(t, key(99)))
+}
+
+func (suite *SimpleDbSuite) TestTableHeader() {
+	tmp, _ := CreateTable(filesys.Fs, "db", "table")
+	CloseTable(tmp)
+	data := readFile("table")
+	data[8] = 100
+	writeFile("unknown codec", data)
+	_, err := RecoverTable(filesys.Fs, "db", "unknown codec")
+	suite.Equal(ErrCorrupt, err)
+}
+
+func (suite *SimpleDbSuite) TestCompressionOption() {
+	opts := noCompactionOptions()
+	opts.Compression = ZlibCompression
+	db := mustDb(NewDbWithOptions(opts))
+	for k := uint64(0); k < 100; k++ {
+		suite.NoError(Write(db, key(k), jsonValue(k)))
+	}
+	suite.NoError(Compact(db))
+	suite.Equal(ZlibCompression, (*db.levels)[0][0].table.codec)
+	suite.NoError(Shutdown(db))
+
+	// tables written with other codecs are still readable
+	opts.Compression = NoCompression
+	db = mustDb(RecoverWithOptions(opts))
+	suite.NoError(Write(db, key(100), jsonValue(100)))
+	suite.NoError(Compact(db))
+	suite.Equal(NoCompression, (*db.levels)[0][0].table.codec)
+	for k := uint64(0); k <= 100; k++ {
+		suite.Equal(bytesPresent(jsonValue(k)), dbRead(db, key(k)))
+	}
+	suite.NoError(CompactAll(db))
+	suite.Equal(bytesPresent(jsonValue(50)), dbRead(db, key(50)))
+}
+
+func (suite *SimpleDbSuite) TestUnknownCompression() {
+	opts := DefaultOptions()
+	opts.Compression = ZlibCompression + 1
+	_, err := NewDbWithOptions(opts)
+	suite.Equal(errCompression, err)
+
+	db := mustDb(NewDb())
+	suite.NoError(Shutdown(db))
+	opts.Compression = -1
+	_, err = RecoverWithOptions(opts)
+	suite.Equal(errCompression, err)
+}
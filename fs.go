@@ -0,0 +1,142 @@
+package simpledb
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+// filesys reports failures by panicking. The wrappers here turn those panics
+// into errors so the database can back out of a failed operation and report it
+// to the caller.
+
+// An FsError is a failed filesystem operation.
+type FsError struct {
+	Op   string
+	Name string
+	Err  error
+}
+
+func (e *FsError) Error() string {
+	if e.Name == "" {
+		return "simpledb: " + e.Op + ": " + e.Err.Error()
+	}
+	return "simpledb: " + e.Op + " " + e.Name + ": " + e.Err.Error()
+}
+
+var errExists = errors.New("file already exists")
+
+// A dbDir is the directory holding a database's files, on the filesystem the
+// database was opened with.
+type dbDir struct {
+	fs   filesys.Filesys
+	path string
+}
+
+// A SyncDirFs is a filesys.DirFs that implements Syncer with fsync(2), since
+// DirFs files are OS file descriptors. Without it, a database on a DirFs never
+// syncs its files, whatever its SyncPolicy.
+type SyncDirFs struct {
+	filesys.DirFs
+}
+
+// NewSyncDirFs creates a SyncDirFs rooted at root, like filesys.NewDirFs.
+func NewSyncDirFs(root string) SyncDirFs {
+	return SyncDirFs{DirFs: filesys.NewDirFs(root)}
+}
+
+// Sync flushes f to stable storage.
+func (fs SyncDirFs) Sync(f filesys.File) {
+	err := syscall.Fsync(int(f))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// defaultDir is where NewDb and Recover keep the database.
+//
+// If filesys.Fs is a DirFs, the database syncs its files through a SyncDirFs.
+func defaultDir() dbDir {
+	fs := filesys.Fs
+	dirFs, ok := fs.(filesys.DirFs)
+	if ok {
+		fs = SyncDirFs{DirFs: dirFs}
+	}
+	return dbDir{fs: fs, path: "db"}
+}
+
+// catchFsError converts a panic from filesys into an FsError in *err.
+//
+// Must be deferred. Runtime errors are bugs rather than filesystem failures,
+// so they are not caught.
+func catchFsError(op string, name string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if _, ok := r.(runtime.Error); ok {
+		panic(r)
+	}
+	e, ok := r.(error)
+	if !ok {
+		e = fmt.Errorf("%v", r)
+	}
+	*err = &FsError{Op: op, Name: name, Err: e}
+}
+
+func fsCreate(d dbDir, name string) (f filesys.File, err error) {
+	defer catchFsError("create", name, &err)
+	f, ok := d.fs.Create(d.path, name)
+	if !ok {
+		return f, &FsError{Op: "create", Name: name, Err: errExists}
+	}
+	return f, nil
+}
+
+func fsOpen(d dbDir, name string) (f filesys.File, err error) {
+	defer catchFsError("open", name, &err)
+	return d.fs.Open(d.path, name), nil
+}
+
+func fsAppend(d dbDir, f filesys.File, p []byte) (err error) {
+	defer catchFsError("append", "", &err)
+	d.fs.Append(f, p)
+	return nil
+}
+
+func fsReadAt(d dbDir, f filesys.File, off uint64, length uint64) (p []byte, err error) {
+	defer catchFsError("read", "", &err)
+	return d.fs.ReadAt(f, off, length), nil
+}
+
+func fsClose(d dbDir, f filesys.File) (err error) {
+	defer catchFsError("close", "", &err)
+	d.fs.Close(f)
+	return nil
+}
+
+func fsDelete(d dbDir, name string) (err error) {
+	defer catchFsError("delete", name, &err)
+	d.fs.Delete(d.path, name)
+	return nil
+}
+
+func fsAtomicCreate(d dbDir, name string, data []byte) (err error) {
+	defer catchFsError("create", name, &err)
+	d.fs.AtomicCreate(d.path, name, data)
+	return nil
+}
+
+func fsList(d dbDir) (names []string, err error) {
+	defer catchFsError("list", d.path, &err)
+	return d.fs.List(d.path), nil
+}
+
+func fsSync(d dbDir, f filesys.File) (err error) {
+	defer catchFsError("sync", "", &err)
+	syncFile(d.fs, f)
+	return nil
+}
@@ -0,0 +1,230 @@
+package simpledb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+var errInjected = errors.New("injected failure")
+
+// failingFs is a MemFs that fails to create or append to the files in fail
+type failingFs struct {
+	*filesys.MemFs
+	fail map[string]bool
+	// the names of the files created
+	names map[filesys.File]string
+}
+
+func (fs failingFs) Create(dir, fname string) (filesys.File, bool) {
+	if fs.fail[fname] {
+		panic(errInjected)
+	}
+	f, ok := fs.MemFs.Create(dir, fname)
+	if ok {
+		fs.names[f] = fname
+	}
+	return f, ok
+}
+
+func (fs failingFs) Append(f filesys.File, data []byte) {
+	if fs.fail[fs.names[f]] {
+		panic(errInjected)
+	}
+	fs.MemFs.Append(f, data)
+}
+
+func (fs failingFs) AtomicCreate(dir, fname string, data []byte) {
+	if fs.fail[fname] {
+		panic(errInjected)
+	}
+	fs.MemFs.AtomicCreate(dir, fname, data)
+}
+
+func useFailingFs() failingFs {
+	fs := failingFs{
+		MemFs: filesys.NewMemFs(),
+		fail:  make(map[string]bool),
+		names: make(map[filesys.File]string),
+	}
+	fs.Mkdir("db")
+	filesys.Fs = fs
+	return fs
+}
+
+func (suite *SimpleDbSuite) TestCreateExistingDb() {
+	db := mustDb(NewDb())
+	suite.NoError(Shutdown(db))
+	_, err := NewDb()
+	suite.Require().Error(err)
+	fsErr, ok := err.(*FsError)
+	suite.Require().True(ok, "%v should be an FsError", err)
+	suite.Equal(errExists, fsErr.Err)
+}
+
+func (suite *SimpleDbSuite) TestCompactFailsCreatingTable() {
+	fs := useFailingFs()
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(2), []byte("value 2")))
+	fs.fail["table.2"] = true
+	err := Compact(db)
+	suite.Require().Error(err)
+	suite.Equal(errInjected, err.(*FsError).Err)
+	suite.Equal(1, len((*db.levels)[0]))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
+
+	// the writes are still in the log
+	suite.NoError(Shutdown(db))
+	db = mustDb(Recover())
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestCompactFailsInstallingManifest() {
+	fs := useFailingFs()
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(2), []byte("value 2")))
+	fs.fail["manifest.0"] = true
+	suite.Error(Compact(db))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
+	state, err := recoverManifest(defaultDir())
+	suite.NoError(err)
+	suite.Equal(1, len(state.levels[0]))
+	suite.Equal("table.1", state.levels[0][0].name)
+
+	// newer writes take precedence over the restored ones
+	suite.NoError(Write(db, key(2), []byte("v2 new")))
+	fs.fail["manifest.0"] = false
+	suite.NoError(Compact(db))
+	suite.NotEqual("manifest.0", db.manifest.name,
+		"the manifest should start over after a failed append")
+	suite.NoError(Close(db))
+	db = mustDb(Recover())
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(present("v2 new"), dbRead(db, key(2)))
+	suite.NotContains(filesys.List("db"), "table.2",
+		"failed table should be cleaned up")
+}
+
+func (suite *SimpleDbSuite) TestWritesAfterLogFailure() {
+	fs := useFailingFs()
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	fs.fail["log.0"] = true
+	suite.Error(Write(db, key(2), []byte("v2")))
+	fs.fail["log.0"] = false
+	// the log stays failed, and rejected writes are never visible
+	suite.Error(Write(db, key(3), []byte("v3")))
+	suite.Error(Delete(db, key(1)))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(missing, dbRead(db, key(3)))
+	suite.Error(Compact(db))
+}
+
+func (suite *SimpleDbSuite) TestStalledWriteAfterLogFailure() {
+	fs := useFailingFs()
+	opts := DefaultOptions()
+	opts.BufferSoftLimit = 0
+	opts.BufferHardLimit = 1000
+	db := mustDb(NewDbWithOptions(opts))
+	fs.fail["log.0"] = true
+
+	// the first write fills the buffer and fails the log, so compactions
+	// fail too, and the other write has to give up instead of waiting for one
+	done := make(chan error)
+	go func() {
+		done <- Write(db, key(1), make([]byte, 2000))
+	}()
+	go func() {
+		done <- Write(db, key(2), []byte("v"))
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			suite.Error(err)
+		case <-time.After(5 * time.Second):
+			suite.FailNow("stalled write hung after the log failed")
+		}
+	}
+}
+
+func TestSyncDirFs(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "simpledb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := NewSyncDirFs(root)
+	fs.Mkdir("db")
+	db, err := Open(fs, "db", DefaultOptions())
+	assert.NoError(err)
+	assert.NoError(Write(db, key(1), []byte("v1")))
+	assert.NoError(Compact(db))
+	assert.NoError(Write(db, key(2), []byte("v2")))
+	assert.NoError(Shutdown(db))
+
+	// NewDb and Recover sync a DirFs too
+	oldFs := filesys.Fs
+	defer func() { filesys.Fs = oldFs }()
+	filesys.Fs = fs.DirFs
+	_, ok := defaultDir().fs.(Syncer)
+	assert.True(ok, "defaultDir should sync a DirFs")
+	db, err = Recover()
+	assert.NoError(err)
+	assert.Equal(present("v1"), dbRead(db, key(1)))
+	assert.Equal(present("v2"), dbRead(db, key(2)))
+	assert.NoError(Shutdown(db))
+}
+
+func (suite *SimpleDbSuite) TestOpenAfterFailedInit() {
+	fs := useFailingFs()
+	fs.fail["CURRENT"] = true
+	_, err := Open(fs, "db", DefaultOptions())
+	suite.Require().Error(err)
+	fs.fail["CURRENT"] = false
+	db := mustDb(Open(fs, "db", DefaultOptions()))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Shutdown(db))
+	db = mustDb(Open(fs, "db", DefaultOptions()))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestOpenAfterInitCrash() {
+	// a crash before newDb wrote CURRENT
+	writeFile(logName(0), nil)
+	writeFile(manifestFileName(0), []byte("partial manifest"))
+	writeFile("notes.txt", []byte("notes"))
+	db := mustDb(Open(filesys.Fs, "db", DefaultOptions()))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Shutdown(db))
+	db = mustDb(Open(filesys.Fs, "db", DefaultOptions()))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal([]byte("notes"), readFile("notes.txt"))
+}
+
+func (suite *SimpleDbSuite) TestOpenWithoutCurrent() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(2), []byte("v2")))
+	suite.NoError(Shutdown(db))
+	filesys.Delete("db", "CURRENT")
+	files := filesys.List("db")
+
+	// the tables and logs hold data, so Open leaves them alone
+	_, err := Open(filesys.Fs, "db", DefaultOptions())
+	suite.Equal(errNoCurrent, err)
+	suite.ElementsMatch(files, filesys.List("db"))
+}
@@ -0,0 +1,271 @@
+package simpledb
+
+import (
+	"bytes"
+	"sort"
+)
+
+// An iterEntry is a buffered write visible to an iterator; a nil value is a
+// tombstone.
+type iterEntry struct {
+	key   []byte
+	value []byte
+	// value is a merge operand, which still needs to be resolved
+	merge bool
+}
+
+// An Iterator scans a range of keys in order.
+//
+// The iterator sees the database as of NewIterator; later writes are not
+// reflected. Call Close when done to release the tables the iterator reads
+// from.
+//
+// If reading the table fails, the iterator becomes invalid and Err reports the
+// error.
+type Iterator struct {
+	start []byte
+	// nil if the range has no upper bound
+	end []byte
+	// the buffered writes in range, sorted by key
+	buf  []iterEntry
+	bufI int
+	// the tables, newest first, which are shadowed by buf
+	tables []*tableIter
+	// the sequence number the iterator reads at
+	seq uint64
+	// the time the iterator reads at, for expiring writes
+	now uint64
+	// the failure to resolve a merge operand, if any
+	err error
+	// the current position
+	valid  bool
+	key    []byte
+	value  []byte
+	closed bool
+}
+
+// inRange reports whether k is in [start, end], where a nil end is unbounded
+func inRange(k []byte, start []byte, end []byte) bool {
+	if bytes.Compare(k, start) < 0 {
+		return false
+	}
+	return end == nil || bytes.Compare(k, end) <= 0
+}
+
+// addBufferEntries merges a buffer's writes in the range [start, end] and
+// visible at seq into entries, overwriting older entries; writes expired at
+// now are deletions
+func addBufferEntries(entries map[string]iterEntry,
+	buf map[string][]version, start []byte, end []byte, seq uint64,
+	now uint64) {
+	for k, versions := range buf {
+		key := []byte(k)
+		v, ok := visibleVersion(versions, seq)
+		if ok && expired(v.expires, now) {
+			v = version{seq: v.seq, value: nil, merge: false, expires: 0}
+		}
+		if ok && inRange(key, start, end) {
+			entries[k] = iterEntry{key: key, value: v.value, merge: v.merge}
+		}
+	}
+}
+
+// NewIterator creates an iterator over the keys in [start, end], positioned at
+// the first such key. Keys are ordered lexicographically; a nil end means the
+// range has no upper bound.
+func NewIterator(db *Database, start []byte, end []byte) *Iterator {
+	return newIteratorAt(db, start, end, latestSeq, clockNow(db))
+}
+
+// newIteratorAt creates an iterator that sees the writes up to sequence
+// number seq, as of time now.
+func newIteratorAt(db *Database, start []byte, end []byte,
+	seq uint64, now uint64) *Iterator {
+	entries := make(map[string]iterEntry)
+	db.bufferL.RLock()
+	db.tableL.RLock()
+	var tables []*tableIter
+	for _, level := range *db.levels {
+		for _, t := range level {
+			pinTable(t.table)
+			tables = append(tables, newTableIter(t.table))
+		}
+	}
+	db.tableL.RUnlock()
+	// newer data shadows older data, so go from oldest to newest
+	addBufferEntries(entries, *db.rbuffer, start, end, seq, now)
+	addBufferEntries(entries, *db.wbuffer, start, end, seq, now)
+	var err error
+	for k, e := range entries {
+		if e.merge && err == nil {
+			v, _, err2 := readLocked(db, e.key, seq, now)
+			entries[k] = iterEntry{key: e.key, value: v, merge: false}
+			err = err2
+		}
+	}
+	db.bufferL.RUnlock()
+
+	buf := make([]iterEntry, 0, len(entries))
+	for _, e := range entries {
+		buf = append(buf, e)
+	}
+	sort.Slice(buf, func(i, j int) bool {
+		return bytes.Compare(buf[i].key, buf[j].key) < 0
+	})
+	it := &Iterator{
+		start:  start,
+		end:    end,
+		buf:    buf,
+		tables: tables,
+		seq:    seq,
+		now:    now,
+		err:    err,
+		closed: false,
+	}
+	it.Seek(start)
+	return it
+}
+
+// skipPast advances the buffer and tables past k
+func (it *Iterator) skipPast(k []byte) {
+	for it.bufI < len(it.buf) && bytes.Compare(it.buf[it.bufI].key, k) <= 0 {
+		it.bufI++
+	}
+	for _, t := range it.tables {
+		for tableIterValid(t) && bytes.Compare(tableIterEntry(t).Key, k) <= 0 {
+			tableIterNext(t)
+		}
+	}
+}
+
+// tablesErr returns the first error reading the tables, if any
+func (it *Iterator) tablesErr() error {
+	for _, t := range it.tables {
+		err := tableIterErr(t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findNext moves to the smallest key at the current position of the buffer
+// and tables that isn't deleted
+func (it *Iterator) findNext() {
+	for {
+		// skip the versions written after the iterator's sequence number
+		for _, t := range it.tables {
+			for tableIterValid(t) && tableIterEntry(t).Seq > it.seq {
+				tableIterNext(t)
+			}
+		}
+		if it.err != nil || it.tablesErr() != nil {
+			it.valid = false
+			return
+		}
+		// the newest table with the smallest key has its newest version
+		var table *tableIter
+		for _, t := range it.tables {
+			if tableIterValid(t) && (table == nil ||
+				bytes.Compare(tableIterEntry(t).Key,
+					tableIterEntry(table).Key) < 0) {
+				table = t
+			}
+		}
+		bufOk := it.bufI < len(it.buf)
+		if !bufOk && table == nil {
+			it.valid = false
+			return
+		}
+		var e iterEntry
+		if bufOk && (table == nil ||
+			bytes.Compare(it.buf[it.bufI].key,
+				tableIterEntry(table).Key) <= 0) {
+			e = it.buf[it.bufI]
+		} else {
+			te := tableIterEntry(table)
+			e = iterEntry{key: te.Key, value: te.Value}
+			if expired(te.Expires, it.now) {
+				e.value = nil
+			}
+		}
+		if !inRange(e.key, it.start, it.end) {
+			it.valid = false
+			return
+		}
+		if e.value == nil {
+			it.skipPast(e.key)
+			continue
+		}
+		it.valid = true
+		it.key = e.key
+		it.value = e.value
+		return
+	}
+}
+
+// Seek positions the iterator at the first key >= k in its range.
+func (it *Iterator) Seek(k []byte) {
+	if bytes.Compare(k, it.start) < 0 {
+		k = it.start
+	}
+	it.bufI = sort.Search(len(it.buf), func(i int) bool {
+		return bytes.Compare(it.buf[i].key, k) >= 0
+	})
+	for _, t := range it.tables {
+		tableIterSeek(t, k)
+	}
+	it.findNext()
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Next advances to the next key.
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+	it.skipPast(it.key)
+	it.findNext()
+}
+
+// Key returns the current key.
+//
+// The iterator must be Valid.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the current value.
+//
+// The iterator must be Valid.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error, if any, that ended the iteration early.
+func (it *Iterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.tablesErr()
+}
+
+// Close releases the iterator's resources. It must not be used afterward.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	var err error
+	for _, t := range it.tables {
+		err2 := unpinTable(t.t)
+		if err == nil {
+			err = err2
+		}
+	}
+	return err
+}
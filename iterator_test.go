@@ -0,0 +1,147 @@
+package simpledb
+
+import (
+	"encoding/binary"
+)
+
+type kv struct {
+	k []byte
+	v string
+}
+
+func iterAll(it *Iterator) []kv {
+	var kvs []kv
+	for ; it.Valid(); it.Next() {
+		kvs = append(kvs, kv{k: it.Key(), v: string(it.Value())})
+	}
+	return kvs
+}
+
+func (suite *SimpleDbSuite) TestIteratorMerge() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("table 1")))
+	suite.NoError(Write(db, key(3), []byte("table 3")))
+	suite.NoError(Write(db, key(5), []byte("table 5")))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(2), []byte("rbuf 2")))
+	suite.NoError(Write(db, key(3), []byte("rbuf 3")))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(4), []byte("wbuf 4")))
+	suite.NoError(Write(db, key(2), []byte("wbuf 2")))
+	suite.NoError(Delete(db, key(5)))
+
+	it := NewIterator(db, nil, nil)
+	defer it.Close()
+	suite.Equal([]kv{
+		{key(1), "table 1"},
+		{key(2), "wbuf 2"},
+		{key(3), "rbuf 3"},
+		{key(4), "wbuf 4"},
+	}, iterAll(it))
+}
+
+func (suite *SimpleDbSuite) TestIteratorRange() {
+	db := mustDb(NewDb())
+	for k := uint64(0); k < 10; k++ {
+		suite.NoError(Write(db, key(k), []byte{byte(k)}))
+	}
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	it := NewIterator(db, key(3), key(6))
+	defer it.Close()
+	var keys [][]byte
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	suite.Equal([][]byte{key(3), key(4), key(5), key(6)}, keys)
+
+	it.Seek(key(5))
+	suite.True(it.Valid())
+	suite.Equal(key(5), it.Key())
+	suite.Equal([]byte{5}, it.Value())
+	it.Seek(key(0))
+	suite.Equal(key(3), it.Key())
+	it.Seek(key(7))
+	suite.False(it.Valid())
+}
+
+func (suite *SimpleDbSuite) TestIteratorEmpty() {
+	db := mustDb(NewDb())
+	it := NewIterator(db, nil, nil)
+	suite.False(it.Valid())
+	it.Next()
+	suite.False(it.Valid())
+	it.Close()
+}
+
+func (suite *SimpleDbSuite) TestIteratorConcurrentCompact() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Write(db, key(2), []byte("v2")))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	it := NewIterator(db, nil, nil)
+	defer it.Close()
+	// the iterator's table is replaced and deleted, but stays readable
+	suite.NoError(Write(db, key(1), []byte("new v1")))
+	suite.NoError(Delete(db, key(2)))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.Equal([]kv{{key(1), "v1"}, {key(2), "v2"}}, iterAll(it))
+}
+
+func (suite *SimpleDbSuite) TestIteratorAcrossBlocks() {
+	db := mustDb(NewDb())
+	for k := uint64(0); k < 1000; k++ {
+		suite.NoError(Write(db, key(k), []byte("table")))
+	}
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	for k := uint64(0); k < 1000; k += 3 {
+		suite.NoError(Delete(db, key(k)))
+	}
+	suite.NoError(Write(db, key(500), []byte("buffer")))
+	it := NewIterator(db, key(100), key(899))
+	defer it.Close()
+	var n uint64
+	for ; it.Valid(); it.Next() {
+		k := binary.BigEndian.Uint64(it.Key())
+		suite.NotEqual(uint64(0), k%3, "deleted key %d", k)
+		if k == 500 {
+			suite.Equal([]byte("buffer"), it.Value())
+		} else {
+			suite.Equal([]byte("table"), it.Value())
+		}
+		n++
+	}
+	suite.Equal(uint64(800-266), n)
+}
+
+func (suite *SimpleDbSuite) TestIteratorByteOrder() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, []byte("b"), []byte("table b")))
+	suite.NoError(Write(db, []byte("ab"), []byte("table ab")))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, []byte("a"), []byte("wbuf a")))
+	suite.NoError(Write(db, []byte(""), []byte("wbuf empty")))
+	suite.NoError(Write(db, []byte("a\x00"), []byte("wbuf a0")))
+
+	it := NewIterator(db, nil, nil)
+	defer it.Close()
+	suite.Equal([]kv{
+		{[]byte(""), "wbuf empty"},
+		{[]byte("a"), "wbuf a"},
+		{[]byte("a\x00"), "wbuf a0"},
+		{[]byte("ab"), "table ab"},
+		{[]byte("b"), "table b"},
+	}, iterAll(it))
+
+	it2 := NewIterator(db, []byte("a\x00"), []byte("ab"))
+	defer it2.Close()
+	suite.Equal([]kv{
+		{[]byte("a\x00"), "wbuf a0"},
+		{[]byte("ab"), "table ab"},
+	}, iterAll(it2))
+}
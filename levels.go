@@ -0,0 +1,485 @@
+package simpledb
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/tchajed/goose/machine"
+)
+
+// The tables form a log-structured merge tree of numLevels levels.
+//
+// Compact flushes the write buffer into a new table in level 0, so level 0
+// holds one table per flush, newest first, and their key ranges can overlap.
+// Each deeper level holds tables sorted by key with disjoint key ranges, and
+// has a budget of Options.Level1Bytes for level 1, levelMultiplier times
+// more for each level below. Once level 0 has Options.Level0Tables tables, or
+// another level goes over its budget, a merge rewrites tables from that level
+// together with the tables they overlap in the next level into new tables in
+// the next level, so a write is copied about once per level instead of on
+// every compaction.
+//
+// For any key, the versions in a level are newer than those in the levels
+// below it (and within level 0, those in newer tables are newer), so a read
+// searches level 0 newest first and then each level in turn, stopping at the
+// first version it can see. A deletion stays in the tables until a merge
+// writes it to a level with no table below it for the key, since until then
+// it shadows older versions.
+//
+// The manifest records the tables in each level (see manifest.go). Flushes
+// and merges install their tables by logging an edit to it, so a crash leaves
+// either the old tables or the new ones, and recovery deletes the table files
+// the manifest doesn't name.
+
+const (
+	numLevels = 7
+	// each level's budget is this many times the one above it
+	levelMultiplier = 10
+)
+
+// A tableFile is an installed table, with what the manifest records about it.
+type tableFile struct {
+	name string
+	// the size of the table file
+	size uint64
+	// the smallest and largest keys in the table
+	smallest []byte
+	largest  []byte
+	table    Table
+}
+
+func tableFileName(n uint64) string {
+	return "table." + machine.UInt64ToString(n)
+}
+
+// newTableFileName allocates the name of a new table file.
+func newTableFileName(db *Database) string {
+	db.tableL.Lock()
+	n := *db.nextFile
+	*db.nextFile = n + 1
+	db.tableL.Unlock()
+	return tableFileName(n)
+}
+
+// closeTableFile finishes writing a table, like tableWriterClose. Returns
+// false (and deletes the file) if the table is empty.
+func closeTableFile(w tableWriter) (tableFile, bool, error) {
+	if !*w.hasLast {
+		tableWriterAbort(w)
+		return tableFile{}, false, nil
+	}
+	t, err := tableWriterClose(w)
+	if err != nil {
+		return tableFile{}, false, err
+	}
+	return tableFile{
+		name:     w.name,
+		size:     *w.offset,
+		smallest: t.Index[0].FirstKey,
+		largest:  *w.lastKey,
+		table:    t,
+	}, true, nil
+}
+
+// closeTableFiles closes the files of tables that are still installed.
+func closeTableFiles(tables []tableFile) {
+	for _, t := range tables {
+		CloseTable(t.table)
+	}
+}
+
+// deleteTableFiles cleans up tables that were never installed.
+func deleteTableFiles(d dbDir, tables []tableFile) {
+	for _, t := range tables {
+		CloseTable(t.table)
+		fsDelete(d, t.name)
+	}
+}
+
+// retireTableFiles deletes tables that are no longer installed; open
+// iterators can still read them.
+//
+// Assumes tableL is held.
+func retireTableFiles(db *Database, tables []tableFile) error {
+	var err error
+	for _, t := range tables {
+		err2 := retireTable(t.table)
+		err3 := fsDelete(db.dir, t.name)
+		blockCacheEvictTable(db.cache, t.table.id)
+		if err == nil {
+			err = err2
+		}
+		if err == nil {
+			err = err3
+		}
+	}
+	return err
+}
+
+// coversKey reports whether k is in t's key range
+func coversKey(t tableFile, k []byte) bool {
+	return bytes.Compare(t.smallest, k) <= 0 && bytes.Compare(k, t.largest) <= 0
+}
+
+// overlaps reports whether t's key range intersects [smallest, largest]
+func overlaps(t tableFile, smallest []byte, largest []byte) bool {
+	return bytes.Compare(t.smallest, largest) <= 0 &&
+		bytes.Compare(smallest, t.largest) <= 0
+}
+
+// levelFind returns the table of a level below level 0 (sorted, with
+// disjoint ranges) whose range covers k, if any.
+func levelFind(level []tableFile, k []byte) (tableFile, bool) {
+	i := sort.Search(len(level), func(i int) bool {
+		return bytes.Compare(level[i].largest, k) >= 0
+	})
+	if i == len(level) || bytes.Compare(level[i].smallest, k) > 0 {
+		return tableFile{}, false
+	}
+	return level[i], true
+}
+
+// levelsReadEntry finds the newest version of k visible at seq in levels.
+func levelsReadEntry(c *blockCache, levels [][]tableFile, k []byte,
+	seq uint64) (Entry, bool, error) {
+	for l, level := range levels {
+		var candidates []tableFile
+		if l == 0 {
+			candidates = level
+		} else {
+			t, ok := levelFind(level, k)
+			if ok {
+				candidates = []tableFile{t}
+			}
+		}
+		for _, t := range candidates {
+			if !coversKey(t, k) {
+				continue
+			}
+			e, ok, err := tableReadEntry(c, t.table, k, seq)
+			if err != nil || ok {
+				return e, ok, err
+			}
+		}
+	}
+	return Entry{}, false, nil
+}
+
+// tablesReadEntry finds the newest version of k visible at seq in db's
+// tables.
+func tablesReadEntry(db *Database, k []byte, seq uint64) (Entry, bool, error) {
+	db.tableL.RLock()
+	e, ok, err := levelsReadEntry(db.cache, *db.levels, k, seq)
+	db.tableL.RUnlock()
+	return e, ok, err
+}
+
+// coveredBelow reports whether any table in level l or below covers k, in
+// which case a deletion of k written above them has to be kept to shadow it.
+func coveredBelow(levels [][]tableFile, l int, k []byte) bool {
+	for i := l; i < len(levels); i++ {
+		if i == 0 {
+			for _, t := range levels[0] {
+				if coversKey(t, k) {
+					return true
+				}
+			}
+			continue
+		}
+		_, ok := levelFind(levels[i], k)
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func levelSize(level []tableFile) uint64 {
+	n := uint64(0)
+	for _, t := range level {
+		n = n + t.size
+	}
+	return n
+}
+
+// levelBudget is the size level l (> 0) should stay under
+func levelBudget(db *Database, l int) uint64 {
+	b := db.level1Bytes
+	for i := 1; i < l; i++ {
+		b = b * levelMultiplier
+	}
+	return b
+}
+
+// pickMerge chooses a level to merge into the next one, if any needs it.
+func pickMerge(db *Database, levels [][]tableFile) (int, bool) {
+	if db.level0Tables > 0 && uint64(len(levels[0])) >= db.level0Tables {
+		return 0, true
+	}
+	for l := 1; l < numLevels-1; l++ {
+		if db.level1Bytes > 0 && levelSize(levels[l]) > levelBudget(db, l) {
+			return l, true
+		}
+	}
+	return 0, false
+}
+
+// mergeInputs chooses the tables of level l to merge, and the tables of the
+// next level they overlap. Below level 0 one table is merged at a time, going
+// around the level in key order.
+//
+// Assumes mergeL is held.
+func mergeInputs(db *Database, levels [][]tableFile,
+	l int) ([]tableFile, []tableFile) {
+	var inputs []tableFile
+	if l == 0 {
+		inputs = levels[0]
+	} else {
+		level := levels[l]
+		next := 0
+		for i, t := range level {
+			if bytes.Compare(t.smallest, db.mergePointers[l]) > 0 {
+				next = i
+				break
+			}
+		}
+		inputs = []tableFile{level[next]}
+		db.mergePointers[l] = level[next].largest
+	}
+	smallest := inputs[0].smallest
+	largest := inputs[0].largest
+	for _, t := range inputs {
+		if bytes.Compare(t.smallest, smallest) < 0 {
+			smallest = t.smallest
+		}
+		if bytes.Compare(t.largest, largest) > 0 {
+			largest = t.largest
+		}
+	}
+	var overlapping []tableFile
+	for _, t := range levels[l+1] {
+		if overlaps(t, smallest, largest) {
+			overlapping = append(overlapping, t)
+		}
+	}
+	return inputs, overlapping
+}
+
+// installTables returns levels with the tables removed taken out and the
+// tables added put in level l.
+func installTables(levels [][]tableFile, removed []tableFile,
+	l int, added []tableFile) [][]tableFile {
+	gone := make(map[string]bool)
+	for _, t := range removed {
+		gone[t.name] = true
+	}
+	newLevels := make([][]tableFile, numLevels)
+	for i, level := range levels {
+		for _, t := range level {
+			if !gone[t.name] {
+				newLevels[i] = append(newLevels[i], t)
+			}
+		}
+	}
+	if l == 0 {
+		// newest first
+		newLevels[0] = append(append([]tableFile{}, added...), newLevels[0]...)
+		return newLevels
+	}
+	level := append(newLevels[l], added...)
+	sort.Slice(level, func(i, j int) bool {
+		return bytes.Compare(level[i].smallest, level[j].smallest) < 0
+	})
+	newLevels[l] = level
+	return newLevels
+}
+
+// writeMergedTables merges tables (newest first) into new tables for level l
+// of levels, keeping the versions visible to snaps and turning the versions
+// expired at now into deletions. The new tables are split once they reach
+// Options.TableBytes.
+func writeMergedTables(db *Database, tables []tableFile, levels [][]tableFile,
+	l int, snaps []uint64, now uint64) ([]tableFile, error) {
+	iters := make([]*tableIter, len(tables))
+	for i, t := range tables {
+		iters[i] = newTableIter(t.table)
+		tableIterSeek(iters[i], nil)
+	}
+	var out []tableFile
+	var w tableWriter
+	writing := false
+	for {
+		// the smallest key left in any of the tables
+		var k []byte
+		for _, it := range iters {
+			if tableIterValid(it) &&
+				(k == nil || bytes.Compare(tableIterEntry(it).Key, k) < 0) {
+				k = tableIterEntry(it).Key
+			}
+		}
+		if k == nil {
+			break
+		}
+		// gather the versions of k, oldest first (the tables go from newest
+		// to oldest, and each has its versions newest first)
+		var versions []version
+		for i := len(iters) - 1; i >= 0; i-- {
+			it := iters[i]
+			var tv []version
+			for tableIterValid(it) && bytes.Equal(tableIterEntry(it).Key, k) {
+				e := tableIterEntry(it)
+				tv = append(tv, version{seq: e.Seq, value: e.Value,
+					merge: false, expires: e.Expires})
+				tableIterNext(it)
+			}
+			for j := len(tv) - 1; j >= 0; j-- {
+				versions = append(versions, tv[j])
+			}
+		}
+		versions = liveVersions(expireVersions(versions, now), snaps)
+		if !writing {
+			w2, err := newTableWriter(db.dir, newTableFileName(db),
+				db.tableOpts)
+			if err != nil {
+				deleteTableFiles(db.dir, out)
+				return nil, err
+			}
+			w = w2
+			writing = true
+		}
+		err := tablePutVersions(w, k, versions, !coveredBelow(levels, l+1, k))
+		if err == nil && db.tableBytes > 0 &&
+			*w.offset+uint64(len(*w.block)) >= db.tableBytes {
+			t, ok, err2 := closeTableFile(w)
+			writing = false
+			if ok {
+				out = append(out, t)
+			}
+			err = err2
+		}
+		if err != nil {
+			if writing {
+				tableWriterAbort(w)
+			}
+			deleteTableFiles(db.dir, out)
+			return nil, err
+		}
+	}
+	for _, it := range iters {
+		err := tableIterErr(it)
+		if err != nil {
+			if writing {
+				tableWriterAbort(w)
+			}
+			deleteTableFiles(db.dir, out)
+			return nil, err
+		}
+	}
+	if writing {
+		t, ok, err := closeTableFile(w)
+		if err != nil {
+			deleteTableFiles(db.dir, out)
+			return nil, err
+		}
+		if ok {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+// mergeTables merges the tables from (all installed, newest first) into new
+// tables in level l, and installs them in their place.
+//
+// Assumes mergeL is held.
+func mergeTables(db *Database, from []tableFile, l int) error {
+	db.bufferL.RLock()
+	snaps := liveSnapshots(db)
+	now := compactionTime(db)
+	db.bufferL.RUnlock()
+	db.tableL.RLock()
+	levels := *db.levels
+	db.tableL.RUnlock()
+	out, err := writeMergedTables(db, from, levels, l, snaps, now)
+	if err != nil {
+		return err
+	}
+
+	added := make([][]tableFile, numLevels)
+	added[l] = out
+	db.tableL.Lock()
+	err = logEdit(db, versionEdit{
+		seq:      *db.tableSeq,
+		nextFile: *db.nextFile,
+		removed:  from,
+		added:    added,
+	})
+	if err != nil {
+		db.tableL.Unlock()
+		// the edit may still be in the manifest, so leave the files to
+		// recovery
+		closeTableFiles(out)
+		return err
+	}
+	err = retireTableFiles(db, from)
+	db.tableL.Unlock()
+
+	db.stats.mu.Lock()
+	db.stats.stats.LevelMerges = db.stats.stats.LevelMerges + 1
+	db.stats.mu.Unlock()
+	return err
+}
+
+// mergeLevels merges levels into the ones below them until every level is
+// within its limit.
+func mergeLevels(db *Database) error {
+	db.mergeL.Lock()
+	defer db.mergeL.Unlock()
+	for {
+		db.tableL.RLock()
+		levels := *db.levels
+		l, ok := pickMerge(db, levels)
+		var inputs []tableFile
+		var overlapping []tableFile
+		if ok {
+			inputs, overlapping = mergeInputs(db, levels, l)
+		}
+		db.tableL.RUnlock()
+		if !ok {
+			return nil
+		}
+		err := mergeTables(db, append(append([]tableFile{}, inputs...),
+			overlapping...), l+1)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// CompactAll flushes the buffered writes, like Compact, and then merges all
+// the tables into one level, the deepest one in use.
+//
+// Unlike Compact, this rewrites the whole database, which drops every old
+// version, deletion and expired write that no snapshot needs.
+func CompactAll(db *Database) error {
+	err := Compact(db)
+	if err != nil {
+		return err
+	}
+	db.mergeL.Lock()
+	defer db.mergeL.Unlock()
+	db.tableL.RLock()
+	var all []tableFile
+	l := 1
+	for i, level := range *db.levels {
+		all = append(all, level...)
+		if i > 0 && len(level) > 0 {
+			l = i
+		}
+	}
+	db.tableL.RUnlock()
+	if len(all) == 0 {
+		return nil
+	}
+	return mergeTables(db, all, l)
+}
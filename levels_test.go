@@ -0,0 +1,111 @@
+package simpledb
+
+import (
+	"bytes"
+
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+// levelOptions makes small levels, so that a few flushes need merges
+func levelOptions() Options {
+	opts := noCompactionOptions()
+	opts.Level0Tables = 2
+	opts.Level1Bytes = 20 << 10
+	opts.TableBytes = 8 << 10
+	return opts
+}
+
+// checkLevels checks that the tables below level 0 are sorted and disjoint
+func (suite *SimpleDbSuite) checkLevels(db *Database) {
+	for l, level := range *db.levels {
+		if l == 0 {
+			continue
+		}
+		for i := 1; i < len(level); i++ {
+			suite.True(bytes.Compare(level[i-1].largest, level[i].smallest) < 0,
+				"level %d tables overlap", l)
+		}
+	}
+}
+
+func (suite *SimpleDbSuite) TestFlushToLevel0() {
+	db := mustDb(NewDbWithOptions(noCompactionOptions()))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Write(db, key(2), []byte("v2")))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(1), []byte("v1 new")))
+	suite.NoError(Delete(db, key(2)))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.Equal(2, len((*db.levels)[0]), "an empty flush adds no table")
+	suite.Equal(present("v1 new"), dbRead(db, key(1)))
+	suite.Equal(missing, dbRead(db, key(2)))
+	// the deletion has to shadow the older table
+	suite.Equal(4, suite.tableEntries(db))
+	it := NewIterator(db, nil, nil)
+	suite.Equal([]kv{{key(1), "v1 new"}}, iterAll(it))
+	suite.NoError(it.Close())
+
+	suite.NoError(CompactAll(db))
+	suite.Equal(0, len((*db.levels)[0]))
+	suite.Equal(1, suite.tableEntries(db))
+	suite.Equal(present("v1 new"), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestLevelMerges() {
+	db := mustDb(NewDbWithOptions(levelOptions()))
+	value := make([]byte, 100)
+	for round := 0; round < 10; round++ {
+		for k := uint64(0); k < 100; k++ {
+			value[0] = byte(round)
+			suite.NoError(Write(db, key(k*10+uint64(round)), value))
+		}
+		suite.NoError(Write(db, key(0), []byte{byte(round)}))
+		suite.NoError(Compact(db))
+	}
+	suite.True(GetStats(db).LevelMerges > 0)
+	suite.True(len((*db.levels)[0]) < 2, "level 0 should be merged")
+	suite.True(len((*db.levels)[2]) > 0, "level 1 should overflow")
+	suite.checkLevels(db)
+	suite.Equal(bytesPresent([]byte{9}), dbRead(db, key(0)))
+	for k := uint64(1); k < 1000; k++ {
+		v, ok, err := Read(db, key(k))
+		suite.NoError(err)
+		suite.True(ok)
+		suite.Equal(byte(k%10), v[0])
+	}
+	it := NewIterator(db, nil, nil)
+	suite.Equal(1000, len(iterAll(it)))
+	suite.NoError(it.Close())
+}
+
+func (suite *SimpleDbSuite) TestRecoverLevels() {
+	db := mustDb(NewDbWithOptions(levelOptions()))
+	for round := uint64(0); round < 5; round++ {
+		for k := uint64(0); k < 100; k++ {
+			suite.NoError(Write(db, key(k), make([]byte, 100)))
+		}
+		suite.NoError(Write(db, key(1000+round), []byte("v")))
+		suite.NoError(Compact(db))
+	}
+	suite.NoError(Delete(db, key(1000)))
+	suite.NoError(Compact(db))
+	levels := *db.levels
+	suite.NoError(Shutdown(db))
+	// a table left behind by a crash during a merge
+	f, _ := filesys.Create("db", "table.100")
+	filesys.Close(f)
+
+	db = mustDb(RecoverWithOptions(levelOptions()))
+	for l := range levels {
+		suite.Equal(len(levels[l]), len((*db.levels)[l]))
+	}
+	suite.NotContains(filesys.List("db"), "table.100")
+	suite.Equal(missing, dbRead(db, key(1000)))
+	suite.Equal(present("v"), dbRead(db, key(1004)))
+	suite.Equal(bytesPresent(make([]byte, 100)), dbRead(db, key(99)))
+	// new tables don't reuse the names of installed ones
+	suite.NoError(Write(db, key(2000), []byte("v")))
+	suite.NoError(Compact(db))
+	suite.Equal(present("v"), dbRead(db, key(2000)))
+}
@@ -0,0 +1,441 @@
+package simpledb
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tchajed/goose/machine"
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+// The write-ahead log makes buffered writes durable before they reach a
+// table.
+//
+// The log is split into files log.0, log.1, ..., each appended to until the
+// next compaction, which switches to a fresh log. Once the compaction installs
+// a table with the contents of the older logs they are deleted, oldest first.
+// As a result the logs on disk are always a contiguous range ending at the
+// current log, and replaying them in order on top of the table reproduces the
+// database: logs whose contents already made it into the table only re-apply
+// writes that later logs override.
+//
+// If appending to the log fails, the log stops accepting writes: every
+// subsequent write returns the same error.
+
+const (
+	logOpPut    = uint64(0)
+	logOpDelete = uint64(1)
+	// the value holds the records of a WriteBatch
+	logOpBatch = uint64(2)
+	// the value is a merge operand
+	logOpMerge = uint64(3)
+)
+
+// A logRecord is a single operation in the write-ahead log.
+type logRecord struct {
+	Op uint64
+	// the write's sequence number (unused for a batch, whose records have
+	// their own)
+	Seq   uint64
+	Key   []byte
+	Value []byte
+	// when a put expires (0 if never), or when a merge operand was written
+	Expires uint64
+}
+
+func encodeLogRecord(r logRecord, p []byte) []byte {
+	p2 := EncodeUInt64(r.Op, p)
+	p3 := EncodeEntry(Entry{
+		Key: r.Key, Seq: r.Seq, Value: r.Value, Expires: r.Expires,
+	}, p2)
+	return p3
+}
+
+// decodeLogRecord is a Decoder(logRecord)
+func decodeLogRecord(data []byte) (logRecord, uint64) {
+	op, l1 := DecodeUInt64(data)
+	if l1 == 0 {
+		return logRecord{}, 0
+	}
+	e, l2 := DecodeEntry(data[l1:])
+	if l2 == 0 {
+		return logRecord{}, 0
+	}
+	if op == logOpBatch {
+		_, ok := decodeBatch(e.Value)
+		if !ok {
+			return logRecord{}, 0
+		}
+	}
+	return logRecord{
+		Op: op, Seq: e.Seq, Key: e.Key, Value: e.Value, Expires: e.Expires,
+	}, l1 + l2
+}
+
+// logApply applies a log record to a write buffer being recovered, raising
+// seq to the record's sequence number.
+//
+// Records are logged in sequence number order, and seq starts out at the
+// last sequence number in the table, so a record numbered at most seq is
+// already in the table (it is from a log the last compaction didn't get to
+// delete) and is skipped.
+//
+// There are no snapshots during recovery, so the buffer only keeps the newest
+// version of each key, along with any merge operands on top of it.
+func logApply(buf map[string][]version, seq *uint64, r logRecord) {
+	if r.Op == logOpBatch {
+		records, _ := decodeBatch(r.Value)
+		for _, r2 := range records {
+			logApply(buf, seq, r2)
+		}
+		return
+	}
+	if r.Seq <= *seq {
+		return
+	}
+	*seq = r.Seq
+	if r.Op == logOpMerge {
+		operand := make([]byte, len(r.Value))
+		copy(operand, r.Value)
+		buf[string(r.Key)] = append(buf[string(r.Key)], version{
+			seq: r.Seq, value: operand, merge: true, written: r.Expires,
+		})
+		return
+	}
+	if r.Op == logOpDelete {
+		buf[string(r.Key)] = []version{{seq: r.Seq, value: nil}}
+		return
+	}
+	// copy so that the buffer doesn't retain the whole log
+	v := make([]byte, len(r.Value))
+	copy(v, r.Value)
+	buf[string(r.Key)] = []version{
+		{seq: r.Seq, value: v, merge: false, expires: r.Expires},
+	}
+}
+
+func logName(n uint64) string {
+	return "log." + machine.UInt64ToString(n)
+}
+
+// parseFileName returns the number of a file name made of prefix and a
+// number, like a log, table or manifest file name
+func parseFileName(prefix string, name string) (uint64, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(name[len(prefix):], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// parseLogName returns the number of a log file name
+func parseLogName(name string) (uint64, bool) {
+	return parseFileName("log.", name)
+}
+
+// listLogs returns the numbers of all logs on disk, in increasing order
+func listLogs(d dbDir) ([]uint64, error) {
+	names, err := fsList(d)
+	if err != nil {
+		return nil, err
+	}
+	var nums []uint64
+	for _, name := range names {
+		n, ok := parseLogName(name)
+		if ok {
+			nums = append(nums, n)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
+}
+
+func createLog(d dbDir, n uint64) (filesys.File, error) {
+	return fsCreate(d, logName(n))
+}
+
+// replayLog applies all the complete records in log n to buf (see logApply).
+//
+// A record cut short by a crash in the middle of an append ends the log.
+func replayLog(d dbDir, n uint64, buf map[string][]version,
+	seq *uint64) error {
+	f, err := fsOpen(d, logName(n))
+	if err != nil {
+		return err
+	}
+	for b := (lazyFileBuf{offset: 0, next: nil}); ; {
+		r, l := decodeLogRecord(b.next)
+		if l > 0 {
+			logApply(buf, seq, r)
+			b = lazyFileBuf{offset: b.offset + l, next: b.next[l:]}
+			continue
+		} else {
+			p, err := fsReadAt(d, f,
+				b.offset+uint64(len(b.next)), 4096)
+			if err != nil {
+				fsClose(d, f)
+				return err
+			}
+			if len(p) == 0 {
+				break
+			} else {
+				newBuf := append(b.next, p...)
+				b = lazyFileBuf{
+					offset: b.offset,
+					next:   newBuf,
+				}
+				continue
+			}
+		}
+	}
+	return fsClose(d, f)
+}
+
+// A logWriter appends records to the current log with group commit: records
+// are queued in memory, and the first writer to wait on its record flushes the
+// whole queue with one append (and one sync) on behalf of every writer queued
+// behind it.
+type logWriter struct {
+	policy SyncPolicy
+
+	// protects the queue of records and the flushing state
+	mu      *sync.Mutex
+	flushed *sync.Cond
+	// encoded records not yet appended to the file
+	pending []byte
+	// records are numbered consecutively across all logs; numAdded records
+	// have been queued and the first numFlushed have been appended (and
+	// synced, if the policy calls for it)
+	numAdded   uint64
+	numFlushed uint64
+	// a writer is flushing on behalf of the others
+	flushing bool
+	// the first failure to write the log, after which no records are flushed
+	err error
+
+	// protects the file and its number; held while appending
+	fileL *sync.Mutex
+	dir   dbDir
+	file  filesys.File
+	num   uint64
+
+	// for the background syncer under SyncPeriodic
+	stop    chan bool
+	stopped chan bool
+}
+
+func newLogWriter(d dbDir, n uint64, opts Options) (*logWriter, error) {
+	f, err := createLog(d, n)
+	if err != nil {
+		return nil, err
+	}
+	mu := new(sync.Mutex)
+	l := &logWriter{
+		policy:  opts.Sync,
+		mu:      mu,
+		flushed: sync.NewCond(mu),
+		fileL:   new(sync.Mutex),
+		dir:     d,
+		file:    f,
+		num:     n,
+	}
+	if opts.Sync == SyncPeriodic {
+		l.stop = make(chan bool)
+		l.stopped = make(chan bool)
+		go logSyncPeriodically(l, opts.SyncInterval)
+	}
+	return l, nil
+}
+
+// logAdd queues a record and returns a ticket for logWait.
+//
+// Callers hold bufferL, so records are queued in the same order as they are
+// applied to the write buffer.
+func logAdd(l *logWriter, r logRecord) uint64 {
+	l.mu.Lock()
+	l.pending = encodeLogRecord(r, l.pending)
+	l.numAdded = l.numAdded + 1
+	ticket := l.numAdded
+	l.mu.Unlock()
+	return ticket
+}
+
+// logFail records a failure to write the log and wakes up any waiters to
+// report it.
+func logFail(l *logWriter, err error) {
+	l.mu.Lock()
+	if l.err == nil {
+		l.err = err
+	}
+	l.flushed.Broadcast()
+	l.mu.Unlock()
+}
+
+// logErr returns the failure that stopped the log, if any.
+func logErr(l *logWriter) error {
+	l.mu.Lock()
+	err := l.err
+	l.mu.Unlock()
+	return err
+}
+
+// logFlush appends all queued records to the current log.
+//
+// Assumes fileL is held.
+func logFlush(l *logWriter) error {
+	l.mu.Lock()
+	err := l.err
+	p := l.pending
+	l.pending = nil
+	end := l.numAdded
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if len(p) > 0 {
+		err := fsAppend(l.dir, l.file, p)
+		if err == nil && l.policy == SyncAlways {
+			err = fsSync(l.dir, l.file)
+		}
+		if err != nil {
+			logFail(l, err)
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	l.numFlushed = end
+	l.flushed.Broadcast()
+	l.mu.Unlock()
+	return nil
+}
+
+// logWait waits until the record with the given ticket is in the log.
+func logWait(l *logWriter, ticket uint64) error {
+	l.mu.Lock()
+	for l.numFlushed < ticket && l.err == nil {
+		if l.flushing {
+			l.flushed.Wait()
+			continue
+		}
+		l.flushing = true
+		l.mu.Unlock()
+		l.fileL.Lock()
+		logFlush(l)
+		l.fileL.Unlock()
+		l.mu.Lock()
+		l.flushing = false
+	}
+	err := l.err
+	if l.numFlushed >= ticket {
+		// flushed before any failure
+		err = nil
+	}
+	l.mu.Unlock()
+	return err
+}
+
+func logSyncPeriodically(l *logWriter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-l.stop:
+			ticker.Stop()
+			l.stopped <- true
+			return
+		case <-ticker.C:
+			l.fileL.Lock()
+			err := fsSync(l.dir, l.file)
+			if err != nil {
+				logFail(l, err)
+			}
+			l.fileL.Unlock()
+		}
+	}
+}
+
+// logFinish flushes and syncs the current log so it can be closed.
+//
+// Assumes fileL is held.
+func logFinish(l *logWriter) error {
+	err := logFlush(l)
+	if err != nil {
+		return err
+	}
+	if l.policy == SyncPeriodic {
+		err := fsSync(l.dir, l.file)
+		if err != nil {
+			logFail(l, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// logRotate flushes the current log and switches to a fresh one, returning
+// its number.
+//
+// Assumes bufferL is held, so that the new log holds exactly the writes that
+// go into the new write buffer. On failure the current log is unchanged.
+func logRotate(l *logWriter) (uint64, error) {
+	l.fileL.Lock()
+	n := l.num + 1
+	f, err := createLog(l.dir, n)
+	if err != nil {
+		l.fileL.Unlock()
+		return 0, err
+	}
+	err = logFinish(l)
+	if err != nil {
+		fsClose(l.dir, f)
+		fsDelete(l.dir, logName(n))
+		l.fileL.Unlock()
+		return 0, err
+	}
+	// the old log is complete, so failing to close it doesn't lose anything
+	fsClose(l.dir, l.file)
+	l.file = f
+	l.num = n
+	l.fileL.Unlock()
+	return n, nil
+}
+
+// logClose flushes and closes the current log.
+func logClose(l *logWriter) error {
+	if l.stop != nil {
+		l.stop <- true
+		<-l.stopped
+	}
+	l.fileL.Lock()
+	err := logFinish(l)
+	err2 := fsClose(l.dir, l.file)
+	l.fileL.Unlock()
+	if err != nil {
+		return err
+	}
+	return err2
+}
+
+// deleteOldLogs removes all logs before log n, oldest first
+func deleteOldLogs(d dbDir, n uint64) error {
+	logs, err := listLogs(d)
+	if err != nil {
+		return err
+	}
+	for _, old := range logs {
+		if old < n {
+			err := fsDelete(d, logName(old))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
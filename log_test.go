@@ -0,0 +1,257 @@
+package simpledb
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+func TestLogRecordEncoding(t *testing.T) {
+	assert := assert.New(t)
+	r := logRecord{Op: logOpPut, Key: key(3), Value: []byte("value")}
+	buf := encodeLogRecord(r, nil)
+	decoded, l := decodeLogRecord(buf)
+	assert.Equal(uint64(len(buf)), l)
+	assert.Equal(r, decoded)
+
+	_, l = decodeLogRecord(buf[:len(buf)-1])
+	assert.Equal(uint64(0), l, "short record should not decode")
+}
+
+func TestParseLogName(t *testing.T) {
+	assert := assert.New(t)
+	n, ok := parseLogName(logName(12))
+	assert.True(ok)
+	assert.Equal(uint64(12), n)
+	_, ok = parseLogName("table.0")
+	assert.False(ok)
+	_, ok = parseLogName("log.")
+	assert.False(ok)
+}
+
+func (suite *SimpleDbSuite) TestRecoverFromLog() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Write(db, key(2), []byte("value 2")))
+	suite.NoError(Delete(db, key(1)))
+	// crash without closing anything
+	db = mustDb(Recover())
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
+	// recover again, now from the log created by the first recovery
+	suite.NoError(Write(db, key(3), []byte("v3")))
+	db = mustDb(Recover())
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
+	suite.Equal(present("v3"), dbRead(db, key(3)))
+}
+
+func (suite *SimpleDbSuite) TestCompactDeletesLogs() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(2), []byte("value 2")))
+	suite.NoError(Compact(db))
+	logs, err := listLogs(defaultDir())
+	suite.NoError(err)
+	suite.Equal([]uint64{2}, logs)
+	db = mustDb(Recover())
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestRecoverStaleLog() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Write(db, key(2), []byte("value 2")))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(1), []byte("v1 new")))
+	suite.NoError(Delete(db, key(2)))
+	// simulate a crash before the compacted log was deleted
+	f, _ := filesys.Create("db", logName(0))
+	filesys.Append(f, encodeLogRecord(
+		logRecord{Op: logOpPut, Seq: 1, Key: key(1), Value: []byte("v1")}, nil))
+	filesys.Append(f, encodeLogRecord(
+		logRecord{Op: logOpPut, Seq: 2, Key: key(2), Value: []byte("value 2")},
+		nil))
+	filesys.Close(f)
+	db = mustDb(Recover())
+	suite.Equal(present("v1 new"), dbRead(db, key(1)))
+	suite.Equal(missing, dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestRecoverTornLogRecord() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	// simulate a crash in the middle of appending a record
+	p := encodeLogRecord(
+		logRecord{Op: logOpPut, Key: key(2), Value: []byte("value 2")}, nil)
+	filesys.Append(db.log.file, p[:len(p)-2])
+	db = mustDb(Recover())
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(missing, dbRead(db, key(2)))
+}
+
+// syncCountingFs is a MemFs that counts syncs
+type syncCountingFs struct {
+	*filesys.MemFs
+	syncs *uint64
+}
+
+func (fs syncCountingFs) Sync(f filesys.File) {
+	// as slow as a disk, so that writers pile up behind a sync
+	time.Sleep(time.Millisecond)
+	atomic.AddUint64(fs.syncs, 1)
+}
+
+func useSyncCountingFs() syncCountingFs {
+	fs := syncCountingFs{MemFs: filesys.NewMemFs(), syncs: new(uint64)}
+	fs.Mkdir("db")
+	filesys.Fs = fs
+	return fs
+}
+
+func (suite *SimpleDbSuite) TestGroupCommit() {
+	fs := useSyncCountingFs()
+	db := mustDb(NewDb())
+	// not counting the sync of the new manifest
+	initSyncs := atomic.LoadUint64(fs.syncs)
+	var wg sync.WaitGroup
+	for tid := uint64(0); tid < 8; tid++ {
+		wg.Add(1)
+		go func(tid uint64) {
+			for i := uint64(0); i < 50; i++ {
+				suite.NoError(Write(db, key(tid*100+i), []byte("v")))
+			}
+			wg.Done()
+		}(tid)
+	}
+	wg.Wait()
+	syncs := atomic.LoadUint64(fs.syncs) - initSyncs
+	suite.True(syncs > 0, "log should be synced")
+	suite.True(syncs < 400, "concurrent writers should share syncs")
+
+	db = mustDb(Recover())
+	for tid := uint64(0); tid < 8; tid++ {
+		for i := uint64(0); i < 50; i++ {
+			suite.Equal(present("v"), dbRead(db, key(tid*100+i)))
+		}
+	}
+}
+
+func (suite *SimpleDbSuite) TestSyncNever() {
+	fs := useSyncCountingFs()
+	opts := DefaultOptions()
+	opts.Sync = SyncNever
+	db := mustDb(NewDbWithOptions(opts))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(2), []byte("value 2")))
+	suite.NoError(Shutdown(db))
+	suite.Equal(uint64(0), atomic.LoadUint64(fs.syncs))
+	db = mustDb(RecoverWithOptions(opts))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestSyncPeriodic() {
+	fs := useSyncCountingFs()
+	opts := DefaultOptions()
+	opts.Sync = SyncPeriodic
+	opts.SyncInterval = time.Millisecond
+	db := mustDb(NewDbWithOptions(opts))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	time.Sleep(10 * time.Millisecond)
+	suite.True(atomic.LoadUint64(fs.syncs) > 0, "background sync should run")
+	suite.NoError(Shutdown(db))
+	db = mustDb(RecoverWithOptions(opts))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.NoError(Shutdown(db))
+}
+
+func (suite *SimpleDbSuite) TestSyncPeriodicNeedsInterval() {
+	opts := DefaultOptions()
+	opts.Sync = SyncPeriodic
+	opts.SyncInterval = 0
+	_, err := NewDbWithOptions(opts)
+	suite.Equal(errSyncInterval, err)
+
+	db := mustDb(NewDb())
+	suite.NoError(Shutdown(db))
+	_, err = RecoverWithOptions(opts)
+	suite.Equal(errSyncInterval, err)
+}
+
+// unsyncedFs is a MemFs that records the files closed with appends that were
+// never synced
+type unsyncedFs struct {
+	*filesys.MemFs
+	m     *sync.Mutex
+	names map[filesys.File]string
+	dirty map[filesys.File]bool
+	// the names of the files closed without a sync
+	unsynced map[string]bool
+}
+
+func (fs unsyncedFs) Create(dir, fname string) (filesys.File, bool) {
+	f, ok := fs.MemFs.Create(dir, fname)
+	if ok {
+		fs.m.Lock()
+		fs.names[f] = fname
+		fs.m.Unlock()
+	}
+	return f, ok
+}
+
+func (fs unsyncedFs) Append(f filesys.File, data []byte) {
+	fs.MemFs.Append(f, data)
+	fs.m.Lock()
+	fs.dirty[f] = true
+	fs.m.Unlock()
+}
+
+func (fs unsyncedFs) Sync(f filesys.File) {
+	fs.m.Lock()
+	delete(fs.dirty, f)
+	fs.m.Unlock()
+}
+
+func (fs unsyncedFs) Close(f filesys.File) {
+	fs.m.Lock()
+	if fs.dirty[f] {
+		fs.unsynced[fs.names[f]] = true
+	}
+	delete(fs.dirty, f)
+	fs.m.Unlock()
+	fs.MemFs.Close(f)
+}
+
+func useUnsyncedFs() unsyncedFs {
+	fs := unsyncedFs{
+		MemFs:    filesys.NewMemFs(),
+		m:        new(sync.Mutex),
+		names:    make(map[filesys.File]string),
+		dirty:    make(map[filesys.File]bool),
+		unsynced: make(map[string]bool),
+	}
+	fs.Mkdir("db")
+	filesys.Fs = fs
+	return fs
+}
+
+func (suite *SimpleDbSuite) TestTablesSynced() {
+	fs := useUnsyncedFs()
+	db := mustDb(NewDbWithOptions(levelOptions()))
+	for k := uint64(0); k < 100; k++ {
+		suite.NoError(Write(db, key(k), []byte("v")))
+		suite.NoError(Compact(db))
+	}
+	suite.NoError(CompactAll(db))
+	suite.NoError(Shutdown(db))
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	suite.Empty(fs.unsynced, "files closed without a sync")
+}
@@ -0,0 +1,346 @@
+package simpledb
+
+import (
+	"hash/crc32"
+
+	"github.com/tchajed/goose/machine"
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+// The manifest is a log of version edits, each a change to the installed
+// tables: the tables a flush or merge added and removed, the sequence number
+// of the last write in the tables, and the next file number to use for a
+// table or manifest file.
+//
+//	CURRENT  := manifestName
+//	manifest := manifestMagic(u64) manifestVersion(u64) record*
+//	record   := len(u64) checksum(u64) edit
+//	edit     := seq(u64) nextFile(u64) numRemoved(u64) name(slice)*
+//	            numAdded(u64) added*
+//	added    := level(u64) name(slice) size(u64) smallest(slice) largest(slice)
+//
+// Checksums are CRC32C of the edit. The first edit in a manifest file is a
+// snapshot that adds all the tables. Installing a table appends and syncs an
+// edit; a crash in the middle leaves a torn record at the end, which recovery
+// ignores, so the install either happened or didn't.
+//
+// Edits are synced unless the log isn't (see SyncNever).
+//
+// CURRENT names the manifest file in use, and is replaced atomically to
+// switch to a new one. That happens on recovery (filesys can't append to an
+// existing file), when the manifest grows past manifestRotateBytes, and after
+// a failed append, which may have left a torn record that would hide any
+// later edits.
+
+const (
+	manifestMagic   = uint64(0x6d616e6966657374)
+	manifestVersion = uint64(1)
+)
+
+// manifestRotateBytes is the size at which the manifest starts over in a new
+// file
+const manifestRotateBytes = uint64(64 << 10)
+
+// A versionEdit is a change to the installed tables.
+type versionEdit struct {
+	seq      uint64
+	nextFile uint64
+	// the names of the tables removed
+	removed []tableFile
+	// the tables added, by level
+	added [][]tableFile
+}
+
+// A manifestWriter appends edits to the current manifest file.
+type manifestWriter struct {
+	name string
+	file filesys.File
+	size uint64
+	// sync each edit
+	sync bool
+	// an append failed, so the file may end in a torn record
+	broken bool
+}
+
+// A manifestState is the state of the tables that the manifest records.
+type manifestState struct {
+	// the manifest file
+	name     string
+	seq      uint64
+	nextFile uint64
+	levels   [][]tableFile
+}
+
+func manifestFileName(n uint64) string {
+	return "manifest." + machine.UInt64ToString(n)
+}
+
+func encodeVersionEdit(e versionEdit, p []byte) []byte {
+	p = EncodeUInt64(e.seq, p)
+	p = EncodeUInt64(e.nextFile, p)
+	p = EncodeUInt64(uint64(len(e.removed)), p)
+	for _, t := range e.removed {
+		p = EncodeSlice([]byte(t.name), p)
+	}
+	n := 0
+	for _, level := range e.added {
+		n = n + len(level)
+	}
+	p = EncodeUInt64(uint64(n), p)
+	for l, level := range e.added {
+		for _, t := range level {
+			p = EncodeUInt64(uint64(l), p)
+			p = EncodeSlice([]byte(t.name), p)
+			p = EncodeUInt64(t.size, p)
+			p = EncodeSlice(t.smallest, p)
+			p = EncodeSlice(t.largest, p)
+		}
+	}
+	return p
+}
+
+// decodeVersionEdit returns the edit encoded in data, or false if it is
+// malformed.
+func decodeVersionEdit(data []byte) (versionEdit, bool) {
+	seq, l1 := DecodeUInt64(data)
+	nextFile, l2 := DecodeUInt64(data[l1:])
+	numRemoved, l3 := DecodeUInt64(data[l1+l2:])
+	if l1 == 0 || l2 == 0 || l3 == 0 {
+		return versionEdit{}, false
+	}
+	data = data[l1+l2+l3:]
+	var removed []tableFile
+	for i := uint64(0); i < numRemoved; i++ {
+		name, l := decodeSlice(data)
+		if l == 0 {
+			return versionEdit{}, false
+		}
+		removed = append(removed, tableFile{name: string(name)})
+		data = data[l:]
+	}
+	numAdded, l4 := DecodeUInt64(data)
+	if l4 == 0 {
+		return versionEdit{}, false
+	}
+	data = data[l4:]
+	added := make([][]tableFile, numLevels)
+	for i := uint64(0); i < numAdded; i++ {
+		level, l1 := DecodeUInt64(data)
+		if l1 == 0 || level >= numLevels {
+			return versionEdit{}, false
+		}
+		name, l2 := decodeSlice(data[l1:])
+		if l2 == 0 {
+			return versionEdit{}, false
+		}
+		size, l3 := DecodeUInt64(data[l1+l2:])
+		if l3 == 0 {
+			return versionEdit{}, false
+		}
+		smallest, l4 := decodeSlice(data[l1+l2+l3:])
+		if l4 == 0 {
+			return versionEdit{}, false
+		}
+		largest, l5 := decodeSlice(data[l1+l2+l3+l4:])
+		if l5 == 0 {
+			return versionEdit{}, false
+		}
+		added[level] = append(added[level], tableFile{
+			name:     string(name),
+			size:     size,
+			smallest: smallest,
+			largest:  largest,
+			table:    Table{},
+		})
+		data = data[l1+l2+l3+l4+l5:]
+	}
+	if len(data) != 0 {
+		return versionEdit{}, false
+	}
+	return versionEdit{
+		seq:      seq,
+		nextFile: nextFile,
+		removed:  removed,
+		added:    added,
+	}, true
+}
+
+func encodeManifestRecord(e versionEdit, p []byte) []byte {
+	edit := encodeVersionEdit(e, nil)
+	p = EncodeUInt64(uint64(len(edit)), p)
+	p = EncodeUInt64(uint64(crc32.Checksum(edit, castagnoli)), p)
+	return append(p, edit...)
+}
+
+// decodeManifestRecord is a Decoder(versionEdit), which also fails if the
+// record's checksum doesn't match.
+func decodeManifestRecord(data []byte) (versionEdit, uint64) {
+	n, l1 := DecodeUInt64(data)
+	checksum, l2 := DecodeUInt64(data[l1:])
+	if l1 == 0 || l2 == 0 || uint64(len(data[l1+l2:])) < n {
+		return versionEdit{}, 0
+	}
+	edit := data[l1+l2 : l1+l2+n]
+	if uint64(crc32.Checksum(edit, castagnoli)) != checksum {
+		return versionEdit{}, 0
+	}
+	e, ok := decodeVersionEdit(edit)
+	if !ok {
+		return versionEdit{}, 0
+	}
+	return e, l1 + l2 + n
+}
+
+// snapshotEdit is an edit that adds all the tables in levels.
+func snapshotEdit(seq uint64, nextFile uint64, levels [][]tableFile) versionEdit {
+	return versionEdit{
+		seq:      seq,
+		nextFile: nextFile,
+		removed:  nil,
+		added:    levels,
+	}
+}
+
+// applyEdit returns levels with e's tables removed and added.
+func applyEdit(levels [][]tableFile, e versionEdit) [][]tableFile {
+	newLevels := installTables(levels, e.removed, 0, nil)
+	for l, added := range e.added {
+		if len(added) > 0 {
+			newLevels = installTables(newLevels, nil, l, added)
+		}
+	}
+	return newLevels
+}
+
+// createManifest starts a manifest file numbered n with the edit e, and makes
+// it the current manifest.
+func createManifest(d dbDir, n uint64, e versionEdit,
+	sync bool) (manifestWriter, error) {
+	name := manifestFileName(n)
+	f, err := fsCreate(d, name)
+	if err != nil {
+		return manifestWriter{}, err
+	}
+	p := EncodeUInt64(manifestMagic, nil)
+	p = EncodeUInt64(manifestVersion, p)
+	p = encodeManifestRecord(e, p)
+	err = fsAppend(d, f, p)
+	if err == nil && sync {
+		err = fsSync(d, f)
+	}
+	if err == nil {
+		err = fsAtomicCreate(d, "CURRENT", []byte(name))
+	}
+	if err != nil {
+		fsClose(d, f)
+		fsDelete(d, name)
+		return manifestWriter{}, err
+	}
+	return manifestWriter{name: name, file: f, size: uint64(len(p)),
+		sync: sync, broken: false}, nil
+}
+
+// rotateManifest switches db to a new manifest file, starting with a
+// snapshot of the tables in levels.
+//
+// Assumes tableL is held.
+func rotateManifest(db *Database, seq uint64, levels [][]tableFile) error {
+	n := *db.nextFile
+	*db.nextFile = n + 1
+	m, err := createManifest(db.dir, n,
+		snapshotEdit(seq, *db.nextFile, levels), db.manifest.sync)
+	if err != nil {
+		return err
+	}
+	// if these fail, recovery deletes the old manifest instead
+	fsClose(db.dir, db.manifest.file)
+	fsDelete(db.dir, db.manifest.name)
+	*db.manifest = m
+	return nil
+}
+
+// logEdit records e in the manifest, and then applies it to db's tables.
+//
+// If logging fails, the edit may or may not take effect on recovery, so the
+// caller must keep the files of any tables it adds (recovery deletes them if
+// they aren't installed).
+//
+// Assumes tableL is held.
+func logEdit(db *Database, e versionEdit) error {
+	levels := applyEdit(*db.levels, e)
+	m := db.manifest
+	if m.broken || m.size >= manifestRotateBytes {
+		err := rotateManifest(db, e.seq, levels)
+		if err != nil {
+			return err
+		}
+	} else {
+		p := encodeManifestRecord(e, nil)
+		err := fsAppend(db.dir, m.file, p)
+		if err == nil && m.sync {
+			err = fsSync(db.dir, m.file)
+		}
+		if err != nil {
+			m.broken = true
+			return err
+		}
+		m.size = m.size + uint64(len(p))
+	}
+	*db.levels = levels
+	*db.tableSeq = e.seq
+	return nil
+}
+
+// readWholeFile reads all of the file name.
+func readWholeFile(d dbDir, name string) ([]byte, error) {
+	f, err := fsOpen(d, name)
+	if err != nil {
+		return nil, err
+	}
+	size, err := fileSize(d, f)
+	if err != nil {
+		fsClose(d, f)
+		return nil, err
+	}
+	data, err := fsReadAt(d, f, 0, size)
+	fsClose(d, f)
+	return data, err
+}
+
+// recoverManifest replays the current manifest, up to any torn record at its
+// end. The tables it returns are not opened yet.
+func recoverManifest(d dbDir) (manifestState, error) {
+	current, err := readWholeFile(d, "CURRENT")
+	if err != nil {
+		return manifestState{}, err
+	}
+	name := string(current)
+	data, err := readWholeFile(d, name)
+	if err != nil {
+		return manifestState{}, err
+	}
+	magic, l1 := DecodeUInt64(data)
+	version, l2 := DecodeUInt64(data[l1:])
+	if l1 == 0 || l2 == 0 || magic != manifestMagic ||
+		version != manifestVersion {
+		return manifestState{}, ErrCorrupt
+	}
+	data = data[l1+l2:]
+	s := manifestState{
+		name:     name,
+		seq:      0,
+		nextFile: 0,
+		levels:   make([][]tableFile, numLevels),
+	}
+	for {
+		e, l := decodeManifestRecord(data)
+		if l == 0 {
+			break
+		}
+		s.seq = e.seq
+		s.nextFile = e.nextFile
+		s.levels = applyEdit(s.levels, e)
+		data = data[l:]
+	}
+	return s, nil
+}
@@ -0,0 +1,150 @@
+package simpledb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+func TestVersionEditEncoding(t *testing.T) {
+	assert := assert.New(t)
+	added := make([][]tableFile, numLevels)
+	added[0] = []tableFile{
+		{name: "table.3", size: 100, smallest: key(1), largest: key(5)},
+		{name: "table.2", size: 200, smallest: key(0), largest: key(9)},
+	}
+	added[2] = []tableFile{
+		{name: "table.1", size: 300, smallest: key(0), largest: key(4)},
+	}
+	e := versionEdit{
+		seq:      7,
+		nextFile: 8,
+		removed:  []tableFile{{name: "table.0"}},
+		added:    added,
+	}
+	p := encodeManifestRecord(e, nil)
+	decoded, l := decodeManifestRecord(p)
+	assert.Equal(uint64(len(p)), l)
+	assert.Equal(uint64(7), decoded.seq)
+	assert.Equal(uint64(8), decoded.nextFile)
+	assert.Equal([]tableFile{{name: "table.0"}}, decoded.removed)
+	assert.Equal(added[0], decoded.added[0])
+	assert.Equal(added[2], decoded.added[2])
+	assert.Empty(decoded.added[1])
+
+	_, l = decodeManifestRecord(p[:len(p)-1])
+	assert.Equal(uint64(0), l, "torn record")
+	p[len(p)-1] ^= 1
+	_, l = decodeManifestRecord(p)
+	assert.Equal(uint64(0), l, "bad checksum")
+}
+
+func TestApplyEdit(t *testing.T) {
+	assert := assert.New(t)
+	levels := make([][]tableFile, numLevels)
+	levels = applyEdit(levels, versionEdit{
+		added: [][]tableFile{{{name: "table.1"}}},
+	})
+	added := make([][]tableFile, numLevels)
+	added[0] = []tableFile{{name: "table.2"}}
+	added[1] = []tableFile{
+		{name: "table.4", smallest: key(5)},
+		{name: "table.3", smallest: key(1)},
+	}
+	levels = applyEdit(levels, versionEdit{added: added})
+	assert.Equal([]tableFile{{name: "table.2"}, {name: "table.1"}}, levels[0])
+	assert.Equal("table.3", levels[1][0].name, "levels are in key order")
+
+	levels = applyEdit(levels, versionEdit{
+		removed: []tableFile{{name: "table.1"}, {name: "table.4"}},
+	})
+	assert.Equal([]tableFile{{name: "table.2"}}, levels[0])
+	assert.Equal(1, len(levels[1]))
+}
+
+func (suite *SimpleDbSuite) TestRecoverTornManifest() {
+	db := mustDb(NewDbWithOptions(noCompactionOptions()))
+	for k := uint64(0); k < 3; k++ {
+		suite.NoError(Write(db, key(k), []byte("v")))
+		suite.NoError(Compact(db))
+	}
+	name := db.manifest.name
+	suite.NoError(Shutdown(db))
+
+	// a crash while appending an edit leaves part of it at the end
+	data := readFile(name)
+	torn := encodeManifestRecord(versionEdit{seq: 100, nextFile: 100}, nil)
+	filesys.Delete("db", name)
+	writeFile(name, append(data, torn[:len(torn)-2]...))
+
+	db = mustDb(RecoverWithOptions(noCompactionOptions()))
+	suite.Equal(3, len((*db.levels)[0]))
+	suite.Equal(uint64(3), *db.tableSeq)
+	for k := uint64(0); k < 3; k++ {
+		suite.Equal(present("v"), dbRead(db, key(k)))
+	}
+	suite.NotContains(filesys.List("db"), name,
+		"recovery should start a new manifest")
+}
+
+func (suite *SimpleDbSuite) TestManifestNextFile() {
+	db := mustDb(NewDbWithOptions(noCompactionOptions()))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(2), []byte("v2")))
+	suite.NoError(Compact(db))
+	suite.NoError(CompactAll(db))
+	nextFile := *db.nextFile
+	suite.NoError(Shutdown(db))
+
+	// the newest table files are gone, but their numbers aren't reused
+	db = mustDb(RecoverWithOptions(noCompactionOptions()))
+	suite.Equal(manifestFileName(nextFile), db.manifest.name)
+	suite.Equal(nextFile+1, *db.nextFile)
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(present("v2"), dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestManifestRotates() {
+	db := mustDb(NewDbWithOptions(levelOptions()))
+	name := db.manifest.name
+	k := uint64(0)
+	for ; db.manifest.name == name; k++ {
+		suite.Require().True(k < 5000, "manifest never rotated")
+		suite.NoError(Write(db, key(k), []byte("v")))
+		suite.NoError(Compact(db))
+	}
+	suite.True(db.manifest.size < manifestRotateBytes)
+	suite.NotContains(filesys.List("db"), name)
+	levels := *db.levels
+	suite.NoError(Shutdown(db))
+
+	db = mustDb(RecoverWithOptions(levelOptions()))
+	for l := range levels {
+		suite.Equal(len(levels[l]), len((*db.levels)[l]))
+	}
+	for i := uint64(0); i < k; i++ {
+		suite.Equal(present("v"), dbRead(db, key(i)))
+	}
+}
+
+func (suite *SimpleDbSuite) TestRecoverUnswitchedManifest() {
+	db := mustDb(NewDbWithOptions(noCompactionOptions()))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	nextFile := *db.nextFile
+	suite.NoError(Shutdown(db))
+
+	// a crash after creating the next manifest, but before switching CURRENT
+	// to it, leaves it behind
+	writeFile(manifestFileName(nextFile), []byte("partial manifest"))
+	for i := 0; i < 2; i++ {
+		db = mustDb(RecoverWithOptions(noCompactionOptions()))
+		suite.Equal(manifestFileName(nextFile), db.manifest.name)
+		suite.Equal(present("v1"), dbRead(db, key(1)))
+		nextFile = *db.nextFile
+		suite.NoError(Shutdown(db))
+		writeFile(manifestFileName(nextFile), []byte("partial manifest"))
+	}
+}
@@ -0,0 +1,117 @@
+package simpledb
+
+import (
+	"errors"
+)
+
+// Merge operands let a client update a value without reading it first.
+//
+// Merge buffers the operand as a version of the key like any other write,
+// but one that applies to the versions below it instead of replacing them.
+// Reads resolve the operands they find on top of the newest write or
+// deletion (going down to the table if needed), and compaction folds them
+// into plain values, so tables never hold operands.
+
+// A MergeFunc combines a merge operand with the existing value of key, which
+// is nil if key is not in the database, and returns the new value.
+//
+// The function must be deterministic and must not modify its arguments.
+type MergeFunc func(key []byte, existing []byte, operand []byte) []byte
+
+// ErrNoMergeFunc is returned when a merge operand has to be resolved but the
+// database has no Options.Merge.
+var ErrNoMergeFunc = errors.New("simpledb: no merge function")
+
+// resolveVersions finds the write of a key visible at seq in its versions
+// (oldest first), adding any merge operands on top of it to operands (newest
+// first).
+//
+// Returns the write (with a nil value if the key was deleted), or false if
+// versions has no write or deletion at seq and the value is in older data.
+func resolveVersions(versions []version, seq uint64,
+	operands *[]version) (version, bool) {
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if v.seq > seq {
+			continue
+		}
+		if !v.merge {
+			return v, true
+		}
+		*operands = append(*operands, v)
+	}
+	return version{}, false
+}
+
+// applyOperands merges operands (newest first) into base, the version of key
+// k they apply to (with a nil value if k has no value), and returns the
+// version they produce.
+//
+// An operand applies to no value if base had already expired when the
+// operand was written; otherwise the result expires along with base (see
+// ttl.go).
+func applyOperands(f MergeFunc, k []byte, base version,
+	operands []version) (version, error) {
+	if len(operands) == 0 {
+		return base, nil
+	}
+	if f == nil {
+		return version{}, ErrNoMergeFunc
+	}
+	v := base
+	for i := len(operands) - 1; i >= 0; i-- {
+		o := operands[i]
+		value := v.value
+		expires := v.expires
+		if expired(expires, o.written) {
+			value = nil
+			expires = 0
+		}
+		merged := f(k, value, o.value)
+		if merged == nil {
+			// a merge always leaves a value
+			merged = make([]byte, 0)
+		}
+		v = version{seq: o.seq, value: merged, merge: false, expires: expires}
+	}
+	return v, nil
+}
+
+// foldVersions replaces the merge operands in versions, all the versions of
+// key k (oldest first), with the values they produce.
+func foldVersions(f MergeFunc, k []byte, versions []version) ([]version, error) {
+	folded := make([]version, len(versions))
+	var base version
+	for i, v := range versions {
+		if v.merge {
+			merged, err := applyOperands(f, k, base, []version{v})
+			if err != nil {
+				return nil, err
+			}
+			base = merged
+		} else {
+			base = v
+		}
+		folded[i] = base
+	}
+	return folded, nil
+}
+
+// Merge combines operand with the value of k using the database's merge
+// function (see Options.Merge), without reading the value first.
+//
+// Returns ErrNoMergeFunc if the database has no merge function; otherwise
+// errors are as for Write.
+func Merge(db *Database, k []byte, operand []byte) error {
+	if db.merge == nil {
+		return ErrNoMergeFunc
+	}
+	if operand == nil {
+		// nil is reserved for tombstones
+		operand = make([]byte, 0)
+	}
+	return bufferedWrite(db, func() (uint64, bool, error) {
+		v := version{value: operand, merge: true, written: clockNow(db)}
+		return writeLocked(db, k, v), true, nil
+	})
+}
@@ -0,0 +1,124 @@
+package simpledb
+
+import (
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+// appendMerge appends operands to the existing value
+func appendMerge(key []byte, existing []byte, operand []byte) []byte {
+	v := append([]byte{}, existing...)
+	return append(v, operand...)
+}
+
+func mergeOptions() Options {
+	opts := DefaultOptions()
+	opts.Merge = appendMerge
+	return opts
+}
+
+func (suite *SimpleDbSuite) TestMerge() {
+	db := mustDb(NewDbWithOptions(mergeOptions()))
+	suite.NoError(Merge(db, key(1), []byte("a")))
+	suite.NoError(Merge(db, key(1), []byte("b")))
+	suite.Equal(present("ab"), dbRead(db, key(1)))
+	suite.NoError(Write(db, key(2), []byte("x")))
+	suite.NoError(Merge(db, key(2), []byte("y")))
+	suite.Equal(present("xy"), dbRead(db, key(2)))
+	suite.NoError(Delete(db, key(2)))
+	suite.NoError(Merge(db, key(2), []byte("z")))
+	suite.Equal(present("z"), dbRead(db, key(2)))
+	suite.NoError(Merge(db, key(3), nil))
+	suite.Equal(present(""), dbRead(db, key(3)))
+}
+
+func (suite *SimpleDbSuite) TestMergeAcrossLayers() {
+	db := mustDb(NewDbWithOptions(mergeOptions()))
+	suite.NoError(Write(db, key(1), []byte("table")))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.NoError(Merge(db, key(1), []byte(" rbuf")))
+	suite.NoError(Compact(db))
+	suite.NoError(Merge(db, key(1), []byte(" wbuf")))
+	suite.Equal(present("table rbuf wbuf"), dbRead(db, key(1)))
+	it := NewIterator(db, nil, nil)
+	suite.Equal([]kv{{key(1), "table rbuf wbuf"}}, iterAll(it))
+	suite.NoError(it.Close())
+
+	// once compacted, the operands are folded into one value
+	suite.NoError(CompactAll(db))
+	suite.Equal(1, suite.tableEntries(db))
+	db.bufferL.Lock()
+	shrinkReadBuffer(db, 0)
+	db.bufferL.Unlock()
+	suite.Equal(present("table rbuf wbuf"), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestMergeSnapshot() {
+	db := mustDb(NewDbWithOptions(mergeOptions()))
+	suite.NoError(Write(db, key(1), []byte("a")))
+	suite.NoError(Compact(db))
+	suite.NoError(Merge(db, key(1), []byte("b")))
+	s := Snapshot(db)
+	suite.NoError(Merge(db, key(1), []byte("c")))
+	suite.NoError(Write(db, key(1), []byte("new")))
+	suite.NoError(Merge(db, key(1), []byte("d")))
+	suite.Equal(present("ab"), suite.snapRead(s, key(1)))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.Equal(present("ab"), suite.snapRead(s, key(1)))
+	suite.Equal(present("newd"), dbRead(db, key(1)))
+	suite.NoError(s.Close())
+}
+
+func (suite *SimpleDbSuite) TestMergeKeepsBase() {
+	versions := []version{
+		{seq: 1, value: []byte("a")},
+		{seq: 2, value: []byte("b"), merge: true},
+		{seq: 3, value: []byte("c")},
+		{seq: 4, value: []byte("d"), merge: true},
+	}
+	live := liveVersions(versions, nil)
+	suite.Equal(versions[2:], live)
+	folded, err := foldVersions(appendMerge, key(1), versions)
+	suite.NoError(err)
+	suite.Equal([]version{
+		{seq: 1, value: []byte("a")},
+		{seq: 2, value: []byte("ab")},
+		{seq: 3, value: []byte("c")},
+		{seq: 4, value: []byte("cd")},
+	}, folded)
+}
+
+func (suite *SimpleDbSuite) TestMergeRecover() {
+	db := mustDb(NewDbWithOptions(mergeOptions()))
+	suite.NoError(Merge(db, key(1), []byte("a")))
+	suite.NoError(Compact(db))
+	suite.NoError(Merge(db, key(1), []byte("b")))
+	suite.NoError(Merge(db, key(1), []byte("c")))
+	// simulate a crash before the compacted log was deleted, which would
+	// apply "a" twice if it were replayed
+	f, _ := filesys.Create("db", logName(0))
+	filesys.Append(f, encodeLogRecord(logRecord{
+		Op: logOpMerge, Seq: 1, Key: key(1), Value: []byte("a"),
+	}, nil))
+	filesys.Close(f)
+	db = mustDb(RecoverWithOptions(mergeOptions()))
+	suite.Equal(present("abc"), dbRead(db, key(1)))
+	suite.NoError(Close(db))
+	db = mustDb(RecoverWithOptions(mergeOptions()))
+	suite.Equal(present("abc"), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestMergeWithoutFunc() {
+	db := mustDb(NewDbWithOptions(mergeOptions()))
+	suite.NoError(Merge(db, key(1), []byte("a")))
+	db = mustDb(Recover())
+	suite.Equal(ErrNoMergeFunc, Merge(db, key(1), []byte("b")))
+	_, _, err := Read(db, key(1))
+	suite.Equal(ErrNoMergeFunc, err)
+	suite.Equal(ErrNoMergeFunc, Compact(db))
+	it := NewIterator(db, nil, nil)
+	suite.False(it.Valid())
+	suite.Equal(ErrNoMergeFunc, it.Err())
+	suite.NoError(it.Close())
+}
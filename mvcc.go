@@ -0,0 +1,100 @@
+package simpledb
+
+import (
+	"sort"
+)
+
+// Multi-version concurrency control: every write gets a sequence number, one
+// more than the last, and a reader at sequence number s sees the newest
+// version of each key with a sequence number <= s.
+//
+// Sequence numbers are assigned under bufferL, in the same order the writes
+// are applied to the write buffer and logged. The buffers keep a list of
+// versions per key, and tables store each version as its own entry, newest
+// first. A version is kept only while it is the newest one, or the one some
+// live snapshot sees; older versions are dropped when a key is written and
+// when a compaction copies the key into the new table.
+//
+// The last sequence number survives a restart through the logs (each record
+// carries its sequence number) and the manifest (which records the last
+// sequence number in the tables it lists).
+
+// A version is one write of a key: its value (nil for a delete) as of
+// sequence number seq.
+type version struct {
+	seq   uint64
+	value []byte
+	// value is a merge operand, to combine with the older versions
+	merge bool
+	// when the version expires, as a Unix time in nanoseconds (0 if never)
+	expires uint64
+	// for a merge operand, when it was written, which decides whether it
+	// applies to an expired value (see ttl.go)
+	written uint64
+}
+
+// latestSeq is the sequence number at which all writes are visible.
+const latestSeq = ^uint64(0)
+
+// visibleVersion returns the newest of versions (oldest first) as of seq.
+func visibleVersion(versions []version, seq uint64) (version, bool) {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].seq <= seq {
+			return versions[i], true
+		}
+	}
+	return version{}, false
+}
+
+// liveVersions drops the versions (oldest first) that no reader can see:
+// those superseded by a newer version that every snapshot in snaps (sorted
+// in increasing order) also sees. A merge operand doesn't supersede the
+// versions it applies to.
+func liveVersions(versions []version, snaps []uint64) []version {
+	keep := make([]bool, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		if i == len(versions)-1 {
+			keep[i] = true
+			continue
+		}
+		v := versions[i]
+		next := versions[i+1]
+		if keep[i+1] && next.merge {
+			keep[i] = true
+			continue
+		}
+		// is there a snapshot in [v.seq, next.seq)?
+		j := sort.Search(len(snaps), func(j int) bool {
+			return snaps[j] >= v.seq
+		})
+		keep[i] = j < len(snaps) && snaps[j] < next.seq
+	}
+	var live []version
+	for i, v := range versions {
+		if keep[i] {
+			live = append(live, v)
+		}
+	}
+	return live
+}
+
+// liveSnapshots returns the sequence numbers of db's open snapshots, in
+// increasing order.
+//
+// Assumes bufferL is held.
+func liveSnapshots(db *Database) []uint64 {
+	snaps := make([]uint64, 0, len(db.snapshots))
+	for s := range db.snapshots {
+		snaps = append(snaps, s)
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i] < snaps[j] })
+	return snaps
+}
+
+// nextSeq assigns the sequence number for a new write.
+//
+// Assumes bufferL is held.
+func nextSeq(db *Database) uint64 {
+	*db.seq = *db.seq + 1
+	return *db.seq
+}
@@ -0,0 +1,148 @@
+package simpledb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+func TestLiveVersions(t *testing.T) {
+	assert := assert.New(t)
+	versions := []version{
+		{seq: 1, value: []byte("v1")},
+		{seq: 3, value: nil},
+		{seq: 5, value: []byte("v5")},
+		{seq: 7, value: []byte("v7")},
+	}
+	seqs := func(versions []version) []uint64 {
+		var s []uint64
+		for _, v := range versions {
+			s = append(s, v.seq)
+		}
+		return s
+	}
+	assert.Equal([]uint64{7}, seqs(liveVersions(versions, nil)))
+	assert.Equal([]uint64{3, 7}, seqs(liveVersions(versions, []uint64{4})))
+	assert.Equal([]uint64{1, 5, 7},
+		seqs(liveVersions(versions, []uint64{1, 2, 6})))
+	assert.Equal([]uint64{7}, seqs(liveVersions(versions, []uint64{7, 8})))
+	assert.Equal([]uint64{7}, seqs(liveVersions(versions, []uint64{0})),
+		"a snapshot from before the first version sees nothing")
+
+	v, ok := visibleVersion(versions, 4)
+	assert.True(ok)
+	assert.Equal(uint64(3), v.seq)
+	_, ok = visibleVersion(versions, 0)
+	assert.False(ok)
+}
+
+func (suite *SimpleDbSuite) TestSequenceNumbers() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Delete(db, key(2)))
+	var b WriteBatch
+	b.Put(key(3), []byte("v3"))
+	b.Put(key(4), []byte("v4"))
+	suite.NoError(Apply(db, &b))
+	suite.Equal(uint64(4), *db.seq)
+	suite.Equal([]version{{seq: 4, value: []byte("v4")}},
+		(*db.wbuffer)[string(key(4))])
+
+	// from the logs
+	suite.NoError(Shutdown(db))
+	db = mustDb(Recover())
+	suite.Equal(uint64(4), *db.seq)
+
+	// from the manifest, once the logs are gone
+	suite.NoError(Close(db))
+	db = mustDb(Recover())
+	suite.Equal(uint64(4), *db.seq)
+	suite.NoError(Write(db, key(1), []byte("v1 new")))
+	suite.Equal(uint64(5), *db.seq)
+}
+
+func (suite *SimpleDbSuite) TestBufferKeepsSnapshotVersions() {
+	db := mustDb(NewDbWithOptions(noCompactionOptions()))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Write(db, key(1), []byte("v2")))
+	suite.Equal(1, len((*db.wbuffer)[string(key(1))]))
+
+	s := Snapshot(db)
+	suite.NoError(Write(db, key(1), []byte("v3")))
+	suite.NoError(Write(db, key(1), []byte("v4")))
+	suite.Equal(2, len((*db.wbuffer)[string(key(1))]),
+		"only the snapshot's version and the newest should be kept")
+	suite.Equal(present("v2"), suite.snapRead(s, key(1)))
+	suite.NoError(s.Close())
+	suite.NoError(Write(db, key(1), []byte("v5")))
+	suite.Equal(1, len((*db.wbuffer)[string(key(1))]))
+	suite.Equal(uint64(len(key(1))+2), *db.wbufferBytes)
+}
+
+func (suite *SimpleDbSuite) TestSnapshotSeesDeletedKey() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Write(db, key(2), []byte("v2")))
+	suite.NoError(Compact(db))
+	s := Snapshot(db)
+	suite.NoError(Delete(db, key(1)))
+	suite.NoError(Write(db, key(2), []byte("v2 new")))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+
+	suite.Equal(present("v1"), suite.snapRead(s, key(1)))
+	suite.Equal(present("v2"), suite.snapRead(s, key(2)))
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.Equal(present("v2 new"), dbRead(db, key(2)))
+	it := s.NewIterator(nil, nil)
+	suite.Equal([]kv{{key(1), "v1"}, {key(2), "v2"}}, iterAll(it))
+	suite.NoError(it.Close())
+	it = NewIterator(db, nil, nil)
+	suite.Equal([]kv{{key(2), "v2 new"}}, iterAll(it))
+	suite.NoError(it.Close())
+	// the deletion and old versions are in the table
+	suite.Equal(4, suite.tableEntries(db))
+
+	suite.NoError(s.Close())
+	suite.NoError(CompactAll(db))
+	suite.Equal(1, suite.tableEntries(db))
+}
+
+func (suite *SimpleDbSuite) TestTableVersionsInOneBlock() {
+	w, _ := newTableWriter(defaultDir(), "table", tableOptions{})
+	for k := uint64(0); k < 100; k++ {
+		for seq := uint64(100); seq > 0; seq-- {
+			suite.NoError(tablePut(w, key(k), seq, []byte{byte(seq)}))
+		}
+	}
+	t, _ := tableWriterClose(w)
+	suite.True(len(t.Index) > 1, "table should have multiple blocks")
+	for b := 1; b < len(t.Index); b++ {
+		suite.NotEqual(t.Index[b-1].FirstKey, t.Index[b].FirstKey)
+	}
+	for k := uint64(0); k < 100; k++ {
+		for seq := uint64(1); seq <= 100; seq++ {
+			v, ok, err := tableRead(nil, t, key(k), seq)
+			suite.NoError(err)
+			suite.True(ok)
+			suite.Equal([]byte{byte(seq)}, v)
+		}
+	}
+}
+
+func (suite *SimpleDbSuite) TestCompactStaleLogVersions() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	// simulate a crash before the compacted log was deleted
+	f, _ := filesys.Create("db", logName(0))
+	filesys.Append(f, encodeLogRecord(
+		logRecord{Op: logOpPut, Seq: 1, Key: key(1), Value: []byte("v1")}, nil))
+	filesys.Close(f)
+	db = mustDb(Recover())
+	// the replayed version is already in the table
+	suite.NoError(Compact(db))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(1, suite.tableEntries(db))
+}
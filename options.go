@@ -0,0 +1,148 @@
+package simpledb
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+// SyncPolicy controls when the write-ahead log is synced to disk.
+//
+// Unless the policy is SyncNever, new tables and manifest edits are also
+// synced before they are installed.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs the log before Write returns. Concurrent writers share
+	// a single append and sync (group commit).
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodic syncs the log in the background every SyncInterval, so a
+	// machine crash can lose that much recent data.
+	SyncPeriodic
+	// SyncNever leaves syncing to the operating system.
+	SyncNever
+)
+
+// ReadBufferPolicy controls what happens to the read buffer once a compaction
+// has installed its contents in the new table.
+//
+// The read buffer holds the writes from before the compaction; afterward it
+// only serves as a cache of recently written keys.
+type ReadBufferPolicy int
+
+const (
+	// KeepReadBuffer keeps the whole read buffer until the next compaction,
+	// so the buffers can hold two generations of writes.
+	KeepReadBuffer ReadBufferPolicy = iota
+	// ClearReadBuffer empties the read buffer, so reads of recent writes go
+	// to the table.
+	ClearReadBuffer
+	// BoundReadBuffer shrinks the read buffer to at most ReadBufferBytes.
+	BoundReadBuffer
+)
+
+// Options configures a database.
+type Options struct {
+	Sync SyncPolicy
+	// SyncInterval is the time between syncs under SyncPeriodic.
+	SyncInterval time.Duration
+	// CompactBufferBytes starts a compaction in the background once the
+	// buffered writes take up this many bytes. Zero means no limit.
+	CompactBufferBytes uint64
+	// CompactBufferKeys starts a compaction in the background once this many
+	// keys are buffered. Zero means no limit.
+	CompactBufferKeys uint64
+	// BufferSoftLimit slows down writes once the in-memory buffers take up
+	// this many bytes. Zero means no limit.
+	BufferSoftLimit uint64
+	// BufferHardLimit blocks writes once the in-memory buffers take up this
+	// many bytes, until a compaction frees up memory. Zero means no limit.
+	BufferHardLimit uint64
+	// ReadBuffer is the policy for the read buffer after a compaction.
+	ReadBuffer ReadBufferPolicy
+	// ReadBufferBytes is the size of the read buffer under BoundReadBuffer.
+	ReadBufferBytes uint64
+	// BlockCacheBytes is the size of the cache of table blocks. Zero disables
+	// the cache.
+	BlockCacheBytes uint64
+	// Level0Tables merges level 0 into level 1 once it has this many tables.
+	// Zero means no limit.
+	Level0Tables uint64
+	// Level1Bytes is the size level 1 is kept under by merging it into level
+	// 2; each level below gets ten times as much. Zero means no limit.
+	Level1Bytes uint64
+	// TableBytes is the size at which merges start a new table.
+	TableBytes uint64
+	// BloomBitsPerKey is the size of each new table's Bloom filter, which
+	// lets reads skip tables that don't have the key. More bits make the
+	// filter more accurate: 10 skips about 99% of the tables without the key.
+	// Zero writes tables without filters.
+	BloomBitsPerKey uint64
+	// Compression is the codec for the blocks of new tables.
+	Compression Compression
+	// Merge combines the operands passed to Merge with a key's value. It is
+	// required to use Merge, including to recover a database that has
+	// merge operands in its log.
+	Merge MergeFunc
+	// Clock tells the time, for expiring writes made with WriteWithTTL. A nil
+	// Clock uses time.Now.
+	Clock func() time.Time
+}
+
+// DefaultOptions returns the options used by NewDb and Recover.
+func DefaultOptions() Options {
+	return Options{
+		Sync:               SyncAlways,
+		SyncInterval:       10 * time.Millisecond,
+		CompactBufferBytes: 4 << 20,
+		CompactBufferKeys:  0,
+		BufferSoftLimit:    16 << 20,
+		BufferHardLimit:    32 << 20,
+		ReadBuffer:         KeepReadBuffer,
+		ReadBufferBytes:    1 << 20,
+		BlockCacheBytes:    8 << 20,
+		Level0Tables:       4,
+		Level1Bytes:        16 << 20,
+		TableBytes:         2 << 20,
+		BloomBitsPerKey:    10,
+		Compression:        NoCompression,
+		Merge:              nil,
+		Clock:              time.Now,
+	}
+}
+
+// A Syncer is a filesys.Filesys that can flush a file to stable storage.
+//
+// Files are only synced if the database's filesystem implements Syncer;
+// otherwise the sync policy has no effect, and appends are only as durable
+// as the filesystem makes them. filesys.DirFs doesn't, so a crash of the
+// machine can lose appends the operating system hasn't written back yet; use
+// a SyncDirFs instead.
+type Syncer interface {
+	Sync(f filesys.File)
+}
+
+func syncFile(fs filesys.Filesys, f filesys.File) {
+	s, ok := fs.(Syncer)
+	if ok {
+		s.Sync(f)
+	}
+}
+
+var (
+	errSyncInterval = errors.New(
+		"simpledb: SyncPeriodic needs a positive SyncInterval")
+	errCompression = errors.New("simpledb: unknown Compression")
+)
+
+// checkOptions rejects options a database can't be opened with.
+func checkOptions(opts Options) error {
+	if opts.Sync == SyncPeriodic && opts.SyncInterval <= 0 {
+		return errSyncInterval
+	}
+	if !validCompression(opts.Compression) {
+		return errCompression
+	}
+	return nil
+}
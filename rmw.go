@@ -0,0 +1,64 @@
+package simpledb
+
+import (
+	"bytes"
+)
+
+// Read-modify-write operations hold bufferL for writing from the read to the
+// write, so no other write to the database can come in between. The read
+// goes through all the layers (write buffer, read buffer and table), like
+// Read.
+
+// CompareAndSwap sets k to newV if its current value is oldV, and reports
+// whether it did.
+//
+// A nil oldV means k must not be in the database, and a nil newV deletes k.
+// Errors are as for Read and Write; on an error from reading k, nothing is
+// written.
+func CompareAndSwap(db *Database, k []byte,
+	oldV []byte, newV []byte) (bool, error) {
+	swapped := false
+	err := bufferedWrite(db, func() (uint64, bool, error) {
+		v, ok, err := readLocked(db, k, latestSeq, clockNow(db))
+		if err != nil {
+			return 0, false, err
+		}
+		if ok != (oldV != nil) || !bytes.Equal(v, oldV) {
+			return 0, false, nil
+		}
+		swapped = true
+		return writeLocked(db, k, version{value: newV}), true, nil
+	})
+	return swapped, err
+}
+
+// Update atomically replaces the value of k with the result of f.
+//
+// f gets the current value of k and whether k is in the database, and returns
+// the new value and whether k should be in the database afterward (returning
+// false deletes k). f runs while the database is locked for writing, so it
+// should be quick and must not use db.
+//
+// Errors are as for Read and Write; on an error from reading k, f is not
+// called.
+func Update(db *Database, k []byte,
+	f func(old []byte, ok bool) ([]byte, bool)) error {
+	return bufferedWrite(db, func() (uint64, bool, error) {
+		v, ok, err := readLocked(db, k, latestSeq, clockNow(db))
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			// buffered values are shared, so f gets its own copy
+			v = append([]byte{}, v...)
+		}
+		newV, present := f(v, ok)
+		if !present {
+			newV = nil
+		} else if newV == nil {
+			// nil is reserved for tombstones
+			newV = make([]byte, 0)
+		}
+		return writeLocked(db, k, version{value: newV}), true, nil
+	})
+}
@@ -0,0 +1,106 @@
+package simpledb
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+func (suite *SimpleDbSuite) TestCompareAndSwap() {
+	db := mustDb(NewDb())
+	ok, err := CompareAndSwap(db, key(1), nil, []byte("v1"))
+	suite.NoError(err)
+	suite.True(ok, "should create a missing key")
+	ok, err = CompareAndSwap(db, key(1), nil, []byte("v1 again"))
+	suite.NoError(err)
+	suite.False(ok, "key is no longer missing")
+	ok, _ = CompareAndSwap(db, key(1), []byte("wrong"), []byte("v2"))
+	suite.False(ok)
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	ok, _ = CompareAndSwap(db, key(1), []byte("v1"), []byte("v2"))
+	suite.True(ok)
+	suite.Equal(present("v2"), dbRead(db, key(1)))
+	ok, _ = CompareAndSwap(db, key(1), []byte("v2"), nil)
+	suite.True(ok, "should delete")
+	suite.Equal(missing, dbRead(db, key(1)))
+
+	db = mustDb(Recover())
+	suite.Equal(missing, dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestCompareAndSwapEmptyValue() {
+	db := mustDb(NewDb())
+	ok, _ := CompareAndSwap(db, key(1), []byte{}, []byte("v1"))
+	suite.False(ok, "empty value shouldn't match a missing key")
+	suite.NoError(Write(db, key(1), nil))
+	ok, _ = CompareAndSwap(db, key(1), nil, []byte("v1"))
+	suite.False(ok, "missing shouldn't match an empty value")
+	ok, _ = CompareAndSwap(db, key(1), []byte{}, []byte("v1"))
+	suite.True(ok)
+}
+
+func (suite *SimpleDbSuite) TestCompareAndSwapBelowWriteBuffer() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("table")))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(2), []byte("rbuf")))
+	suite.NoError(Compact(db))
+	ok, _ := CompareAndSwap(db, key(1), nil, []byte("new"))
+	suite.False(ok, "should see the value in the table")
+	ok, _ = CompareAndSwap(db, key(2), nil, []byte("new"))
+	suite.False(ok, "should see the value in the rbuffer")
+	ok, _ = CompareAndSwap(db, key(1), []byte("table"), []byte("new 1"))
+	suite.True(ok)
+	ok, _ = CompareAndSwap(db, key(2), []byte("rbuf"), []byte("new 2"))
+	suite.True(ok)
+	suite.Equal(present("new 1"), dbRead(db, key(1)))
+	suite.Equal(present("new 2"), dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestUpdate() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.NoError(Update(db, key(1), func(old []byte, ok bool) ([]byte, bool) {
+		suite.True(ok)
+		suite.Equal([]byte("v1"), old)
+		return append(old, " updated"...), true
+	}))
+	suite.Equal(present("v1 updated"), dbRead(db, key(1)))
+	suite.NoError(Update(db, key(2), func(old []byte, ok bool) ([]byte, bool) {
+		suite.False(ok)
+		return nil, true
+	}))
+	suite.Equal(present(""), dbRead(db, key(2)))
+	suite.NoError(Update(db, key(1), func(old []byte, ok bool) ([]byte, bool) {
+		return nil, false
+	}))
+	suite.Equal(missing, dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestUpdateCounter() {
+	db := mustDb(NewDb())
+	incr := func(old []byte, ok bool) ([]byte, bool) {
+		n := uint64(0)
+		if ok {
+			n = binary.BigEndian.Uint64(old)
+		}
+		return key(n + 1), true
+	}
+	var wg sync.WaitGroup
+	for tid := 0; tid < 4; tid++ {
+		wg.Add(1)
+		go func(tid int) {
+			for i := 0; i < 100; i++ {
+				suite.NoError(Update(db, key(0), incr))
+				if tid == 0 && i%10 == 0 {
+					suite.NoError(Compact(db))
+				}
+			}
+			wg.Done()
+		}(tid)
+	}
+	wg.Wait()
+	suite.Equal(present(string(key(400))), dbRead(db, key(0)))
+}
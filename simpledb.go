@@ -1,15 +1,28 @@
 /*
-Package simpledb implements a one-table version of LevelDB
+Package simpledb implements a key-value store in the style of LevelDB, as a
+leveled log-structured merge tree.
 
-It buffers all writes in memory; to make data durable, call Compact().
-This operation re-writes all of the data in the database
-(including in-memory writes) in a crash-safe manner.
-Keys in the table are cached for efficient reads.
+Open a database in a directory with Open; a process can have any number of
+databases open at once, on the same or different filesystems.
+
+It buffers all writes in memory, backed by a write-ahead log so that they
+survive a crash. To move buffered writes into the tables, call Compact(),
+which writes them to a new table in level 0 in a crash-safe manner and then
+merges any levels that have grown too large into the level below (see
+levels.go). Tables are sorted, and an index of each table's blocks is cached
+for efficient reads.
+
+Filesystem failures are returned as errors. An operation that fails leaves
+the database as it was, except that a failure to write the log stops further
+writes.
 */
 package simpledb
 
 import (
+	"bytes"
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/tchajed/goose/machine"
 	"github.com/tchajed/goose/machine/filesys"
@@ -17,24 +30,56 @@ import (
 
 // A Table provides access to an immutable copy of data on the filesystem,
 // along with an index for fast random access.
+//
+// The data is sorted by key and split into blocks; the index holds only the
+// first key of each block, so a lookup reads one block.
 type Table struct {
-	Index map[uint64]uint64
+	Index []BlockHandle
 	File  filesys.File
+	dir   dbDir
+	// the table's Bloom filter (nil if it has none)
+	filter bloomFilter
+	// the codec of its compressed blocks
+	codec Compression
+	// identifies the table's blocks in the block cache
+	id   uint64
+	pins *tablePins
 }
 
-// CreateTable creates a new, empty table.
-func CreateTable(p string) Table {
-	index := make(map[uint64]uint64)
-	f, _ := filesys.Create("db", p)
-	filesys.Close(f)
-	f2 := filesys.Open("db", p)
-	return Table{Index: index, File: f2}
+// tablePins tracks readers that hold on to a table beyond a single operation
+// (like iterators), so that the table's file stays open until they finish.
+type tablePins struct {
+	mu      *sync.Mutex
+	count   uint64
+	retired bool
 }
 
-// Entry represents a (key, value) pair.
+func newTable(d dbDir, index []BlockHandle, filter bloomFilter,
+	codec Compression, f filesys.File) Table {
+	pins := &tablePins{mu: new(sync.Mutex), count: 0, retired: false}
+	return Table{Index: index, File: f, dir: d, filter: filter, codec: codec,
+		id: newTableID(), pins: pins}
+}
+
+// CreateTable creates a new, empty table named p in dir.
+func CreateTable(fs filesys.Filesys, dir string, p string) (Table, error) {
+	w, err := newTableWriter(dbDir{fs: fs, path: dir}, p, tableOptions{})
+	if err != nil {
+		return Table{}, err
+	}
+	return tableWriterClose(w)
+}
+
+// Entry represents a (key, value) pair, as written at sequence number Seq.
+//
+// A nil Value records that the key was deleted.
 type Entry struct {
-	Key   uint64
+	Key   []byte
+	Seq   uint64
 	Value []byte
+	// Expires is when the entry expires, as a Unix time in nanoseconds, or 0
+	// if it never does
+	Expires uint64
 }
 
 // DecodeUInt64 is a Decoder(uint64)
@@ -53,22 +98,59 @@ func DecodeUInt64(p []byte) (uint64, uint64) {
 
 // DecodeEntry is a Decoder(Entry)
 func DecodeEntry(data []byte) (Entry, uint64) {
-	key, l1 := DecodeUInt64(data)
+	key, l1 := decodeSlice(data)
 	if l1 == 0 {
-		return Entry{Key: 0, Value: nil}, 0
+		return Entry{Key: nil, Seq: 0, Value: nil}, 0
 	}
-	valueLen, l2 := DecodeUInt64(data[l1:])
+	tag, l2 := DecodeUInt64(data[l1:])
 	if l2 == 0 {
-		return Entry{Key: 0, Value: nil}, 0
+		return Entry{Key: nil, Seq: 0, Value: nil}, 0
+	}
+	expires := uint64(0)
+	l3 := uint64(0)
+	if tag&2 == 2 {
+		expires, l3 = DecodeUInt64(data[l1+l2:])
+		if l3 == 0 {
+			return Entry{Key: nil, Seq: 0, Value: nil}, 0
+		}
+	}
+	value, l4 := decodeSlice(data[l1+l2+l3:])
+	if l4 == 0 {
+		return Entry{Key: nil, Seq: 0, Value: nil}, 0
 	}
-	if uint64(len(data)) < l1+l2+valueLen {
-		return Entry{Key: 0, Value: nil}, 0
+	if tag&1 == 1 {
+		value = nil
+	} else if value == nil {
+		value = make([]byte, 0)
 	}
-	value := data[l1+l2 : l1+l2+valueLen]
 	return Entry{
-		Key:   key,
-		Value: value,
-	}, l1 + l2 + valueLen
+		Key:     key,
+		Seq:     tag >> 2,
+		Value:   value,
+		Expires: expires,
+	}, l1 + l2 + l3 + l4
+}
+
+// EncodeEntry is an Encoder(Entry)
+//
+// The sequence number, whether the entry expires and whether it is a deletion
+// are packed into one tag, seq<<2 | expires<<1 | deleted. An entry that
+// expires has its expiry right after the tag.
+func EncodeEntry(e Entry, p []byte) []byte {
+	tag := e.Seq << 2
+	if e.Expires != 0 {
+		tag = tag | 2
+	}
+	if e.Value == nil {
+		tag = tag | 1
+	}
+	p2 := EncodeSlice(e.Key, p)
+	p3 := EncodeUInt64(tag, p2)
+	if e.Expires != 0 {
+		p3 = EncodeUInt64(e.Expires, p3)
+	}
+	p4 := EncodeSlice(e.Value, p3)
+	return p4
 }
 
 type lazyFileBuf struct {
@@ -76,87 +158,134 @@ type lazyFileBuf struct {
 	next   []byte
 }
 
-// readTableIndex parses a complete table on disk into a key->offset index
-func readTableIndex(f filesys.File, index map[uint64]uint64) {
-	for buf := (lazyFileBuf{offset: 0, next: nil}); ; {
-		e, l := DecodeEntry(buf.next)
-		if l > 0 {
-			index[e.Key] = 8 + buf.offset
-			buf = lazyFileBuf{offset: buf.offset + l, next: buf.next[l:]}
-			continue
-		} else {
-			p := filesys.ReadAt(f,
-				buf.offset+uint64(len(buf.next)), 4096)
-			if len(p) == 0 {
-				break
-			} else {
-				newBuf := append(buf.next, p...)
-				buf = lazyFileBuf{
-					offset: buf.offset,
-					next:   newBuf,
-				}
-				continue
-			}
-		}
-	}
+// RecoverTable restores the table named p in dir from disk on startup.
+//
+// Only the index at the end of the table is read, unless it's missing or
+// corrupt, in which case the index is rebuilt from the blocks.
+func RecoverTable(fs filesys.Filesys, dir string, p string) (Table, error) {
+	return recoverTable(dbDir{fs: fs, path: dir}, p)
 }
 
-// RecoverTable restores a table from disk on startup.
-func RecoverTable(p string) Table {
-	index := make(map[uint64]uint64)
-	f := filesys.Open("db", p)
-	readTableIndex(f, index)
-	return Table{Index: index, File: f}
+func recoverTable(d dbDir, p string) (Table, error) {
+	f, err := fsOpen(d, p)
+	if err != nil {
+		return Table{}, err
+	}
+	codec, ok, err := readTableHeader(d, f)
+	if err == nil && !ok {
+		err = ErrCorrupt
+	}
+	if err != nil {
+		fsClose(d, f)
+		return Table{}, err
+	}
+	index, filter, ok, err := readTableIndex(d, f)
+	if err == nil && !ok {
+		index, err = scanTableIndex(d, f, codec)
+	}
+	if err != nil {
+		fsClose(d, f)
+		return Table{}, err
+	}
+	return newTable(d, index, filter, codec, f), nil
 }
 
 // CloseTable frees up the fd held by a table.
-func CloseTable(t Table) {
-	filesys.Close(t.File)
+func CloseTable(t Table) error {
+	return fsClose(t.dir, t.File)
+}
+
+// pinTable keeps t open until a matching unpinTable.
+//
+// Assumes t is still installed (that is, the caller holds tableL).
+func pinTable(t Table) {
+	t.pins.mu.Lock()
+	t.pins.count = t.pins.count + 1
+	t.pins.mu.Unlock()
+}
+
+func unpinTable(t Table) error {
+	var err error
+	t.pins.mu.Lock()
+	t.pins.count = t.pins.count - 1
+	if t.pins.retired && t.pins.count == 0 {
+		err = CloseTable(t)
+	}
+	t.pins.mu.Unlock()
+	return err
 }
 
-func readValue(f filesys.File, off uint64) []byte {
-	startBuf := filesys.ReadAt(f, off, 512)
-	totalBytes := machine.UInt64Get(startBuf)
-	// should have enough data for the key if the file is a proper encoding
-	buf := startBuf[8:]
-	haveBytes := uint64(len(buf))
-	if haveBytes < totalBytes {
-		buf2 := filesys.ReadAt(f, off+512, totalBytes-haveBytes)
-		newBuf := append(buf, buf2...)
-		return newBuf
+// retireTable closes a table that is no longer installed, or arranges for
+// the last unpinTable to close it.
+func retireTable(t Table) error {
+	var err error
+	t.pins.mu.Lock()
+	t.pins.retired = true
+	if t.pins.count == 0 {
+		err = CloseTable(t)
 	}
-	return buf[:totalBytes]
+	t.pins.mu.Unlock()
+	return err
 }
 
-func tableRead(t Table, k uint64) ([]byte, bool) {
-	off, ok := t.Index[k]
+// tableReadEntry finds the version of k visible at seq in t, reading blocks
+// through the cache c (which may be nil).
+func tableReadEntry(c *blockCache, t Table, k []byte,
+	seq uint64) (Entry, bool, error) {
+	if !bloomMayContain(t.filter, bloomHash(k)) {
+		return Entry{}, false, nil
+	}
+	b, ok := findBlock(t.Index, k)
 	if !ok {
-		return nil, false
+		return Entry{}, false, nil
+	}
+	p, err := readCachedBlock(c, t, b)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	e, ok := blockRead(p, k, seq)
+	return e, ok, nil
+}
+
+// tableRead looks up the value of k visible at seq in t, like tableReadEntry.
+func tableRead(c *blockCache, t Table, k []byte,
+	seq uint64) ([]byte, bool, error) {
+	e, ok, err := tableReadEntry(c, t, k, seq)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok || e.Value == nil {
+		return nil, false, nil
 	}
-	p := readValue(t.File, off)
-	return p, true
+	// the block may be cached, so the caller gets its own copy
+	v2 := make([]byte, len(e.Value))
+	copy(v2, e.Value)
+	return v2, true, nil
 }
 
 type bufFile struct {
+	dir  dbDir
 	file filesys.File
 	buf  *[]byte
 }
 
-func newBuf(f filesys.File) bufFile {
+func newBuf(d dbDir, f filesys.File) bufFile {
 	buf := new([]byte)
 	return bufFile{
+		dir:  d,
 		file: f,
 		buf:  buf,
 	}
 }
 
-func bufFlush(f bufFile) {
+func bufFlush(f bufFile) error {
 	buf := *f.buf
 	if len(buf) == 0 {
-		return
+		return nil
 	}
-	filesys.Append(f.file, buf)
+	err := fsAppend(f.dir, f.file, buf)
 	*f.buf = nil
+	return err
 }
 
 func bufAppend(f bufFile, p []byte) {
@@ -165,29 +294,83 @@ func bufAppend(f bufFile, p []byte) {
 	*f.buf = buf2
 }
 
-func bufClose(f bufFile) {
-	bufFlush(f)
-	filesys.Close(f.file)
+// bufClose flushes and closes f, syncing it first if sync is set.
+func bufClose(f bufFile, sync bool) error {
+	err := bufFlush(f)
+	if err == nil && sync {
+		err = fsSync(f.dir, f.file)
+	}
+	err2 := fsClose(f.dir, f.file)
+	if err != nil {
+		return err
+	}
+	return err2
 }
 
 type tableWriter struct {
-	index  map[uint64]uint64
+	index  *[]BlockHandle
+	dir    dbDir
 	name   string
 	file   bufFile
 	offset *uint64
+	// encoded entries in the current block
+	block         *[]byte
+	blockFirstKey *[]byte
+	// the last entry added (if any), to check that entries are added in
+	// order
+	lastKey *[]byte
+	lastSeq *uint64
+	hasLast *bool
+	opts    tableOptions
+	// the hashes of the keys added so far, for the Bloom filter
+	hashes *[]uint64
+}
+
+// tableOptions configures how tables are written.
+type tableOptions struct {
+	// the Bloom filter's bits per key (0 for no filter)
+	bitsPerKey uint64
+	// compresses the blocks
+	codec Compression
+	// sync the table before it is installed
+	sync bool
+}
+
+// newDbTableOptions returns the tableOptions for a database's tables
+func newDbTableOptions(opts Options) tableOptions {
+	return tableOptions{
+		bitsPerKey: opts.BloomBitsPerKey,
+		codec:      opts.Compression,
+		sync:       opts.Sync != SyncNever,
+	}
 }
 
-func newTableWriter(p string) tableWriter {
-	index := make(map[uint64]uint64)
-	f, _ := filesys.Create("db", p)
-	buf := newBuf(f)
+// newTableWriter starts writing a table named p, configured by opts.
+func newTableWriter(d dbDir, p string,
+	opts tableOptions) (tableWriter, error) {
+	index := new([]BlockHandle)
+	f, err := fsCreate(d, p)
+	if err != nil {
+		return tableWriter{}, err
+	}
+	buf := newBuf(d, f)
 	off := new(uint64)
-	return tableWriter{
-		index:  index,
-		name:   p,
-		file:   buf,
-		offset: off,
+	w := tableWriter{
+		index:         index,
+		dir:           d,
+		name:          p,
+		file:          buf,
+		offset:        off,
+		block:         new([]byte),
+		blockFirstKey: new([]byte),
+		lastKey:       new([]byte),
+		lastSeq:       new(uint64),
+		hasLast:       new(bool),
+		opts:          opts,
+		hashes:        new([]uint64),
 	}
+	tableWriterAppend(w, encodeTableHeader(opts.codec))
+	return w, nil
 }
 
 func tableWriterAppend(w tableWriter, p []byte) {
@@ -196,13 +379,59 @@ func tableWriterAppend(w tableWriter, p []byte) {
 	*w.offset = off + uint64(len(p))
 }
 
-func tableWriterClose(w tableWriter) Table {
-	bufClose(w.file)
-	f := filesys.Open("db", w.name)
-	return Table{
-		Index: w.index,
-		File:  f,
+// tableWriterFinishBlock writes out the current block (if any) and adds it to
+// the index
+func tableWriterFinishBlock(w tableWriter) error {
+	block := *w.block
+	if len(block) == 0 {
+		return nil
+	}
+	off := *w.offset
+	tmp := encodeBlock(w.opts.codec, block)
+	tableWriterAppend(w, tmp)
+	h := BlockHandle{
+		FirstKey: *w.blockFirstKey,
+		Offset:   off,
+		Length:   uint64(len(tmp)),
 	}
+	*w.index = append(*w.index, h)
+	*w.block = nil
+	// only one block needs to be in memory at a time
+	return bufFlush(w.file)
+}
+
+func tableWriterClose(w tableWriter) (Table, error) {
+	err := tableWriterFinishBlock(w)
+	if err != nil {
+		tableWriterAbort(w)
+		return Table{}, err
+	}
+	var filter bloomFilter
+	if w.opts.bitsPerKey > 0 {
+		filter = newBloomFilter(*w.hashes, w.opts.bitsPerKey)
+	}
+	filterOffset := *w.offset
+	tableWriterAppend(w, encodeTableFooter(*w.index, filter, filterOffset))
+	err = bufClose(w.file, w.opts.sync)
+	if err != nil {
+		fsDelete(w.dir, w.name)
+		return Table{}, err
+	}
+	f, err := fsOpen(w.dir, w.name)
+	if err != nil {
+		fsDelete(w.dir, w.name)
+		return Table{}, err
+	}
+	return newTable(w.dir, *w.index, filter, w.opts.codec, f), nil
+}
+
+// tableWriterAbort cleans up a table that failed to be written.
+//
+// Errors are ignored since the table is already broken; Recover deletes any
+// file left behind.
+func tableWriterAbort(w tableWriter) {
+	fsClose(w.dir, w.file.file)
+	fsDelete(w.dir, w.name)
 }
 
 // EncodeUInt64 is an Encoder(uint64)
@@ -220,62 +449,266 @@ func EncodeSlice(data []byte, p []byte) []byte {
 	return p3
 }
 
-func tablePut(w tableWriter, k uint64, v []byte) {
-	tmp := make([]byte, 0)
-	tmp2 := EncodeUInt64(k, tmp)
-	tmp3 := EncodeSlice(v, tmp2)
+// tablePut adds the version of k with sequence number seq to a table being
+// written; a nil v records a deletion.
+//
+// Keys must be added in increasing order, and the versions of each key from
+// newest to oldest.
+func tablePut(w tableWriter, k []byte, seq uint64, v []byte) error {
+	return tablePutEntry(w, Entry{Key: k, Seq: seq, Value: v, Expires: 0})
+}
 
-	off := *w.offset
-	// index points to encoded value
-	w.index[k] = off + uint64(len(tmp2))
+// tablePutEntry is tablePut for an entry that may expire.
+func tablePutEntry(w tableWriter, e Entry) error {
+	k := e.Key
+	seq := e.Seq
+	newKey := true
+	if *w.hasLast {
+		c := bytes.Compare(k, *w.lastKey)
+		newKey = c > 0
+		if c < 0 || (c == 0 && seq >= *w.lastSeq) {
+			panic("table keys must be added in increasing order")
+		}
+		// all the versions of a key go in one block, so that a read only
+		// needs the block findBlock picks
+		if c > 0 && uint64(len(*w.block)) >= blockSize {
+			err := tableWriterFinishBlock(w)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// copy k, since the caller may reuse it
+	*w.lastKey = append([]byte{}, k...)
+	*w.lastSeq = seq
+	*w.hasLast = true
+	if newKey && w.opts.bitsPerKey > 0 {
+		*w.hashes = append(*w.hashes, bloomHash(k))
+	}
+	tmp := make([]byte, 0)
+	tmp2 := EncodeEntry(e, tmp)
 
-	// write to table
-	tableWriterAppend(w, tmp3)
+	block := *w.block
+	if len(block) == 0 {
+		*w.blockFirstKey = *w.lastKey
+	}
+	*w.block = append(block, tmp2...)
+	return nil
 }
 
 // Database is a handle to an open database.
 type Database struct {
-	wbuffer *map[uint64][]byte
-	rbuffer *map[uint64][]byte
+	// where the database's files live
+	dir     dbDir
+	wbuffer *map[string][]version
+	// the total size of the writes in wbuffer and rbuffer
+	wbufferBytes *uint64
+	rbuffer      *map[string][]version
+	rbufferBytes *uint64
+	// what to do with the rbuffer after a compaction
+	rbufferPolicy ReadBufferPolicy
+	rbufferLimit  uint64
+	// the sequence number of the last write
+	seq *uint64
+	// the number of open snapshots at each sequence number, and the time the
+	// earliest of them was taken
+	snapshots     map[uint64]uint64
+	snapshotTimes map[uint64]uint64
+	// combines merge operands with values (nil if not configured)
+	merge MergeFunc
+	// the time, for expiring writes with a TTL
+	clock func() time.Time
+	// protects the buffers, seq and snapshots
 	bufferL *sync.RWMutex
-	table   *Table
-	// the manifest
-	tableName *string
-	// protects both table and tableName
+	// holds up writes when the buffers use too much memory
+	stall *writeStall
+	// the write-ahead log for the writes in the buffers
+	log *logWriter
+	// the installed tables, by level (see levels.go)
+	levels *[][]tableFile
+	// the sequence number of the last write in the tables
+	tableSeq *uint64
+	// the number of the next table or manifest file
+	nextFile *uint64
+	// the current manifest file
+	manifest *manifestWriter
+	// protects levels, tableSeq, nextFile and manifest
 	tableL *sync.RWMutex
-	// protects constructing shadow tables
+	// protects flushing the write buffer to level 0
 	compactionL *sync.RWMutex
+	// protects merging levels, and mergePointers
+	mergeL *sync.Mutex
+	// where the next merge of each level starts
+	mergePointers [][]byte
+	// when to merge levels (see Options)
+	level0Tables uint64
+	level1Bytes  uint64
+	tableBytes   uint64
+	// how to write new tables (see Options)
+	tableOpts tableOptions
+	// recently read table blocks (nil if disabled)
+	cache *blockCache
+	// runs compactions in the background (nil if disabled)
+	compactor *compactor
+	stats     *dbStats
 }
 
-func makeValueBuffer() *map[uint64][]byte {
-	buf := make(map[uint64][]byte)
-	bufPtr := new(map[uint64][]byte)
+// Buffers map each key to its versions, oldest first. A nil value is a
+// tombstone recording that the key was deleted; Write never stores nil.
+//
+// Buffers are keyed by string(k), since slices can't be map keys.
+func makeValueBuffer() *map[string][]version {
+	buf := make(map[string][]version)
+	bufPtr := new(map[string][]version)
 	*bufPtr = buf
 	return bufPtr
 }
 
+// Open opens the database in dir on fs, which must already exist.
+//
+// If dir holds a database, Open recovers it as after a crash or shutdown;
+// otherwise Open initializes a new, empty database there, first cleaning up
+// after any initialization that didn't finish. A database is only complete
+// once its CURRENT file exists, so Open returns an error if dir has other
+// database files but no CURRENT.
+//
+// Writes are only synced to disk if fs implements Syncer. For a directory on
+// the host filesystem, pass a SyncDirFs rather than a filesys.DirFs.
+func Open(fs filesys.Filesys, dir string, opts Options) (*Database, error) {
+	d := dbDir{fs: fs, path: dir}
+	files, err := fsList(d)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range files {
+		if name == "CURRENT" {
+			return recoverDb(d, opts)
+		}
+	}
+	err = deleteIncompleteDb(d, files)
+	if err != nil {
+		return nil, err
+	}
+	return newDb(d, opts)
+}
+
+var errNoCurrent = errors.New("simpledb: database files without CURRENT")
+
+// deleteIncompleteDb deletes the files of a database whose initialization
+// didn't finish, from the list of files in d, which has no CURRENT.
+//
+// newDb writes CURRENT last, so all it can leave behind is an empty log.0 and
+// manifest.0. Any other database file holds data, and is left alone.
+func deleteIncompleteDb(d dbDir, files []string) error {
+	var leftover []string
+	for _, name := range files {
+		_, isLog := parseLogName(name)
+		_, isTable := parseFileName("table.", name)
+		_, isManifest := parseFileName("manifest.", name)
+		if name == logName(0) || name == manifestFileName(0) {
+			leftover = append(leftover, name)
+		} else if isLog || isTable || isManifest {
+			return errNoCurrent
+		}
+	}
+	for _, name := range leftover {
+		if name == logName(0) {
+			data, err := readWholeFile(d, name)
+			if err != nil {
+				return err
+			}
+			if len(data) > 0 {
+				return errNoCurrent
+			}
+		}
+	}
+	for _, name := range leftover {
+		err := fsDelete(d, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // NewDb initializes a new database on top of an empty filesys.
-func NewDb() Database {
+//
+// The database is stored in the directory "db" on the default filesystem
+// filesys.Fs; use Open to choose the filesystem and directory.
+func NewDb() (*Database, error) {
+	return NewDbWithOptions(DefaultOptions())
+}
+
+// NewDbWithOptions initializes a new database on top of an empty filesys,
+// using opts to configure it.
+func NewDbWithOptions(opts Options) (*Database, error) {
+	return newDb(defaultDir(), opts)
+}
+
+func newDb(d dbDir, opts Options) (*Database, error) {
+	err := checkOptions(opts)
+	if err != nil {
+		return nil, err
+	}
 	wbuf := makeValueBuffer()
 	rbuf := makeValueBuffer()
 	bufferL := new(sync.RWMutex)
-	tableName := "table.0"
-	tableNameRef := new(string)
-	*tableNameRef = tableName
-	table := CreateTable(tableName)
-	tableRef := new(Table)
-	*tableRef = table
+	log, err := newLogWriter(d, 0, opts)
+	if err != nil {
+		return nil, err
+	}
+	// writes are durable as soon as they are logged, so the database must be
+	// recoverable before the first compaction; createManifest writes CURRENT
+	// last, which completes the database
+	levels := make([][]tableFile, numLevels)
+	m, err := createManifest(d, 0, snapshotEdit(0, 1, levels),
+		opts.Sync != SyncNever)
+	if err != nil {
+		logClose(log)
+		fsDelete(d, logName(0))
+		return nil, err
+	}
+	manifest := new(manifestWriter)
+	*manifest = m
+	nextFile := new(uint64)
+	*nextFile = 1
+	levelsRef := new([][]tableFile)
+	*levelsRef = levels
 	tableL := new(sync.RWMutex)
 	compactionL := new(sync.RWMutex)
-	return Database{
-		wbuffer:     wbuf,
-		rbuffer:     rbuf,
-		bufferL:     bufferL,
-		table:       tableRef,
-		tableName:   tableNameRef,
-		tableL:      tableL,
-		compactionL: compactionL,
+	db := &Database{
+		dir:           d,
+		wbuffer:       wbuf,
+		wbufferBytes:  new(uint64),
+		rbuffer:       rbuf,
+		rbufferBytes:  new(uint64),
+		rbufferPolicy: opts.ReadBuffer,
+		rbufferLimit:  opts.ReadBufferBytes,
+		seq:           new(uint64),
+		snapshots:     make(map[uint64]uint64),
+		snapshotTimes: make(map[uint64]uint64),
+		merge:         opts.Merge,
+		clock:         optionsClock(opts),
+		bufferL:       bufferL,
+		stall:         newWriteStall(bufferL, opts),
+		log:           log,
+		levels:        levelsRef,
+		tableSeq:      new(uint64),
+		nextFile:      nextFile,
+		manifest:      manifest,
+		tableL:        tableL,
+		compactionL:   compactionL,
+		mergeL:        new(sync.Mutex),
+		mergePointers: make([][]byte, numLevels),
+		level0Tables:  opts.Level0Tables,
+		level1Bytes:   opts.Level1Bytes,
+		tableBytes:    opts.TableBytes,
+		tableOpts:     newDbTableOptions(opts),
+		cache:         newBlockCache(opts.BlockCacheBytes),
+		stats:         newDbStats(),
 	}
+	startCompactor(db, opts)
+	return db, nil
 }
 
 // Read gets a key from the database.
@@ -284,29 +717,105 @@ func NewDb() Database {
 // the value if k was in the database.
 //
 // Reflects any completed in-memory writes.
-func Read(db Database, k uint64) ([]byte, bool) {
+//
+// Returns an error if reading the table fails, including ErrCorrupt if the
+// table data for k is damaged.
+func Read(db *Database, k []byte) ([]byte, bool, error) {
+	return readAt(db, k, latestSeq, clockNow(db))
+}
+
+// readAt gets the version of k visible at sequence number seq, as of time now
+// (which decides whether it has expired).
+func readAt(db *Database, k []byte, seq uint64,
+	now uint64) ([]byte, bool, error) {
 	db.bufferL.RLock()
+	v, ok, err := readLocked(db, k, seq, now)
+	db.bufferL.RUnlock()
+	return v, ok, err
+}
+
+// readLocked is readAt for a caller that holds bufferL.
+func readLocked(db *Database, k []byte, seq uint64,
+	now uint64) ([]byte, bool, error) {
+	// merge operands on top of the value, newest first
+	var operands []version
 	// first try write buffer
 	buf := *db.wbuffer
-	v, ok := buf[k]
-	if ok {
-		db.bufferL.RUnlock()
-		return v, true
-	}
+	base, ok := resolveVersions(buf[string(k)], seq, &operands)
 	// ...then try read buffer
-	rbuf := *db.rbuffer
-	v2, ok := rbuf[k]
-	if ok {
-		db.bufferL.RUnlock()
-		return v2, true
+	if !ok {
+		rbuf := *db.rbuffer
+		base, ok = resolveVersions(rbuf[string(k)], seq, &operands)
 	}
-	// ...and finally go to the table
-	db.tableL.RLock()
-	tbl := *db.table
-	v3, ok := tableRead(tbl, k)
-	db.tableL.RUnlock()
-	db.bufferL.RUnlock()
-	return v3, ok
+	// ...and finally go to the tables
+	if !ok {
+		e, ok, err := tablesReadEntry(db, k, seq)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok && e.Value != nil {
+			// the block may be cached, so the caller gets its own copy
+			base = version{seq: e.Seq, value: append([]byte{}, e.Value...),
+				merge: false, expires: e.Expires}
+		}
+	}
+	v, err := applyOperands(db.merge, k, base, operands)
+	if err != nil {
+		return nil, false, err
+	}
+	if v.value == nil || expired(v.expires, now) {
+		return nil, false, nil
+	}
+	return v.value, true, nil
+}
+
+// writeLocked assigns a sequence number to v, a write of k (a delete if its
+// value is nil, or a merge operand), logs it and adds it to the write buffer.
+// Returns a ticket for logWait.
+//
+// Assumes bufferL is held.
+func writeLocked(db *Database, k []byte, v version) uint64 {
+	op := logOpPut
+	if v.merge {
+		op = logOpMerge
+	} else if v.value == nil {
+		op = logOpDelete
+	}
+	expires := v.expires
+	if v.merge {
+		expires = v.written
+	}
+	v.seq = nextSeq(db)
+	ticket := logAdd(db.log, logRecord{
+		Op: op, Seq: v.seq, Key: k, Value: v.value, Expires: expires,
+	})
+	bufferWrite(db, string(k), v)
+	return ticket
+}
+
+// bufferedWrite runs write with bufferL held, once the buffers have room for
+// it (see stallWrite), and then waits for what it logged to be in the log.
+// write returns the ticket of its last log record, or false if it didn't
+// write anything after all. A write that fills up the buffer starts a
+// compaction in the background.
+func bufferedWrite(db *Database, write func() (uint64, bool, error)) error {
+	db.bufferL.Lock()
+	err := stallWrite(db)
+	if err != nil {
+		db.bufferL.Unlock()
+		return err
+	}
+	ticket, ok, err := write()
+	if err != nil || !ok {
+		db.bufferL.Unlock()
+		return err
+	}
+	full := bufferFull(db)
+	db.bufferL.Unlock()
+	if full {
+		compactSoon(db.compactor)
+	}
+	return logWait(db.log, ticket)
 }
 
 // Write sets a key to a new value.
@@ -314,214 +823,457 @@ func Read(db Database, k uint64) ([]byte, bool) {
 // Creates a new key-value mapping if k is not in the database and overwrites
 // the previous value if k is present.
 //
-// The new value is buffered in memory. To persist it, call db.Compact().
-func Write(db Database, k uint64, v []byte) {
-	db.bufferL.Lock()
-	buf := *db.wbuffer
-	buf[k] = v
-	db.bufferL.Unlock()
+// The new value is buffered in memory and logged according to the database's
+// SyncPolicy before Write returns; db.Compact() moves it into the table, and
+// a Write that fills up the buffer starts a compaction in the background (see
+// Options.CompactBufferBytes). If the buffers are over their memory budget,
+// Write first slows down or waits for a compaction (see
+// Options.BufferSoftLimit).
+//
+// If logging the write fails, Write returns an error and the write may or may
+// not survive a crash. After that, the log stays failed, and every write
+// returns its error without taking effect.
+func Write(db *Database, k []byte, v []byte) error {
+	if v == nil {
+		// nil is reserved for tombstones
+		v = make([]byte, 0)
+	}
+	return bufferedWrite(db, func() (uint64, bool, error) {
+		return writeLocked(db, k, version{value: v}), true, nil
+	})
 }
 
-func freshTable(p string) string {
-	if p == "table.0" {
-		return "table.1"
-	}
-	if p == "table.1" {
-		return "table.0"
-	}
-	// note that this only works if we guarantee the table is always
-	// either table.0 or table.1
-	return p
+// Delete removes a key from the database.
+//
+// Deleting a key that is not in the database has no effect.
+//
+// The deletion is buffered in memory as a tombstone, which shadows any older
+// value for k until merging the levels drops them both (see CompactAll).
+// Errors are as for Write.
+func Delete(db *Database, k []byte) error {
+	return bufferedWrite(db, func() (uint64, bool, error) {
+		return writeLocked(db, k, version{value: nil}), true, nil
+	})
 }
 
-func tablePutBuffer(w tableWriter, buf map[uint64][]byte) {
-	for k, v := range buf {
-		tablePut(w, k, v)
+// tablePutVersions adds the versions of k (oldest first) to the table w
+// being created.
+//
+// If dropDeletes is set, there is nothing below the new table for a deletion
+// to shadow, so the oldest versions are dropped if they are deletions.
+func tablePutVersions(w tableWriter, k []byte, versions []version,
+	dropDeletes bool) error {
+	oldest := 0
+	for dropDeletes && oldest < len(versions) &&
+		versions[oldest].value == nil {
+		oldest = oldest + 1
 	}
+	for i := len(versions) - 1; i >= oldest; i-- {
+		v := versions[i]
+		err := tablePutEntry(w,
+			Entry{Key: k, Seq: v.seq, Value: v.value, Expires: v.expires})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// add all of table t to the table w being created; skip any keys in the (read)
-// buffer b since those writes overwrite old ones
-func tablePutOldTable(w tableWriter, t Table, b map[uint64][]byte) {
-	for buf := (lazyFileBuf{offset: 0, next: nil}); ; {
-		e, l := DecodeEntry(buf.next)
-		if l > 0 {
-			_, ok := b[e.Key]
-			// only copy the key if it wasn't overwritten in the buffer
-			// (this compacts overall storage when keys are overwritten)
-			if !ok {
-				tablePut(w, e.Key, e.Value)
-			}
-			buf = lazyFileBuf{offset: buf.offset + l, next: buf.next[l:]}
-			continue
-		} else {
-			p := filesys.ReadAt(t.File,
-				buf.offset+uint64(len(buf.next)), 4096)
-			if len(p) == 0 {
-				break
-			} else {
-				newBuf := append(buf.next, p...)
-				buf = lazyFileBuf{
-					offset: buf.offset,
-					next:   newBuf,
-				}
-				continue
+// Build a new level 0 table with the (write) buffer wbuf, keeping only the
+// versions visible to snapshots snaps.
+//
+// The tables never hold merge operands, so an operand with no base in wbuf is
+// folded into the newest version in the tables.
+//
+// Returns false if the table would be empty. On failure, the new table is
+// cleaned up.
+func constructLevel0Table(db *Database, wbuf map[string][]version,
+	snaps []uint64, now uint64) (tableFile, bool, error) {
+	w, err := newTableWriter(db.dir, newTableFileName(db), db.tableOpts)
+	if err != nil {
+		return tableFile{}, false, err
+	}
+	db.tableL.RLock()
+	levels := *db.levels
+	for _, k := range sortedKeys(wbuf) {
+		versions := wbuf[k]
+		var base version
+		if versions[0].merge {
+			e, _, err := levelsReadEntry(db.cache, levels, []byte(k), latestSeq)
+			if err != nil {
+				db.tableL.RUnlock()
+				tableWriterAbort(w)
+				return tableFile{}, false, err
 			}
+			base = version{seq: e.Seq, value: e.Value, merge: false,
+				expires: e.Expires}
+		}
+		folded, err := foldVersions(db.merge, []byte(k),
+			append([]version{base}, versions...))
+		if err != nil {
+			db.tableL.RUnlock()
+			tableWriterAbort(w)
+			return tableFile{}, false, err
+		}
+		// the base is already in the tables
+		versions = folded[1:]
+		versions = liveVersions(expireVersions(versions, now), snaps)
+		err = tablePutVersions(w, []byte(k), versions,
+			!coveredBelow(levels, 0, []byte(k)))
+		if err != nil {
+			db.tableL.RUnlock()
+			tableWriterAbort(w)
+			return tableFile{}, false, err
 		}
 	}
+	db.tableL.RUnlock()
+	return closeTableFile(w)
 }
 
-// Build a new shadow table that incorporates the current table and a
-// (write) buffer wbuf.
-//
-// Assumes all the appropriate locks have been taken.
+// restoreBuffer returns the writes from a failed compaction to the write
+// buffer, where they are shadowed by any newer writes.
 //
-// Returns the old table and new table.
-func constructNewTable(db Database, wbuf map[uint64][]byte) (Table, Table) {
-	oldName := *db.tableName
-	name := freshTable(oldName)
-	w := newTableWriter(name)
-	oldTable := *db.table
-	// add old writes (using the buffer to skip new writes)
-	tablePutOldTable(w, oldTable, wbuf)
-	// add buffered writes
-	tablePutBuffer(w, wbuf)
-	newTable := tableWriterClose(w)
-	return oldTable, newTable
+// They are also still in the old logs, which are only deleted once a
+// compaction succeeds.
+func restoreBuffer(db *Database, buf map[string][]version) {
+	db.bufferL.Lock()
+	wbuf := *db.wbuffer
+	snaps := liveSnapshots(db)
+	for k, versions := range buf {
+		newer := wbuf[k]
+		*db.wbufferBytes = *db.wbufferBytes - versionsSize(k, newer)
+		all := append(append([]version{}, versions...), newer...)
+		merged := liveVersions(all, snaps)
+		wbuf[k] = merged
+		*db.wbufferBytes = *db.wbufferBytes + versionsSize(k, merged)
+	}
+	emptyRbuffer := make(map[string][]version)
+	*db.rbuffer = emptyRbuffer
+	*db.rbufferBytes = 0
+	db.stall.compacted.Broadcast()
+	db.bufferL.Unlock()
 }
 
-// Compact persists in-memory writes to a new table.
+// Compact persists in-memory writes to a new table in level 0, and then
+// merges any levels that are over their limits (see Options.Level0Tables and
+// Options.Level1Bytes).
 //
-// This simple database design must re-write all data to combine in-memory
-// writes with existing writes.
-func Compact(db Database) {
+// If Compact fails before installing the new table, the old tables and
+// manifest stay in place, the writes remain buffered, and the error is
+// returned. Failures afterward, while cleaning up the old logs or merging
+// levels, are also returned, but the new table has taken effect.
+func Compact(db *Database) error {
 	db.compactionL.Lock()
 
-	// first, snapshot the buffered writes that will go into this table.
+	// first, snapshot the buffered writes that will go into this table,
+	// and start a new log for subsequent writes.
 	db.bufferL.Lock()
+	logNum, err := logRotate(db.log)
+	if err != nil {
+		// writers waiting for this compaction have to find out it failed
+		db.stall.compacted.Broadcast()
+		db.bufferL.Unlock()
+		db.compactionL.Unlock()
+		return err
+	}
 	buf := *db.wbuffer
-	emptyWbuffer := make(map[uint64][]byte)
+	// the table keeps the versions these snapshots see, and the manifest
+	// records the last sequence number in the tables
+	snaps := liveSnapshots(db)
+	now := compactionTime(db)
+	lastSeq := *db.seq
+	emptyWbuffer := make(map[string][]version)
 	*db.wbuffer = emptyWbuffer
+	*db.rbufferBytes = *db.wbufferBytes
+	*db.wbufferBytes = 0
 	*db.rbuffer = buf
 	db.bufferL.Unlock()
 
 	// next, construct the new table
-	// NOTE: it's weird to acquire this table lock:
-	//
-	//	- what happens between tableL.RUnlock() and tableL.Lock()? a reader
-	// would be fine since the old table is still valid, and the compaction
-	// log prevents another writer from suddenly installing a new table
-	//
-	// - given this reasoning, why lock the tableL at all? it feels like the
-	// compactionL also implicitly acquires a read-lock on the tableL, since it
-	// guarantees only the compaction itself could be messing with the table,
-	// which it won't do till later in this function
-	db.tableL.RLock()
-	oldTableName := *db.tableName
-	oldTable, t := constructNewTable(db, buf)
-	newTable := freshTable(oldTableName)
-	db.tableL.RUnlock()
+	t, ok, err := constructLevel0Table(db, buf, snaps, now)
+	if err != nil {
+		restoreBuffer(db, buf)
+		db.compactionL.Unlock()
+		return err
+	}
+	var added []tableFile
+	if ok {
+		added = []tableFile{t}
+	}
 
-	// next, install it (persistently and in-memory)
+	// next, install it (persistently and in-memory); the install also
+	// changes what the rbuffer means, so it happens under bufferL
+	db.bufferL.Lock()
 	db.tableL.Lock()
-	*db.table = t
-	*db.tableName = newTable
-	manifestData := []byte(newTable)
-	filesys.AtomicCreate("db", "manifest", manifestData)
-	CloseTable(oldTable)
-	filesys.Delete("db", oldTableName)
-	// note that we don't need to remove the rbuffer (it's just a cache for
-	// the part of the table we just persisted)
+	edit := versionEdit{
+		seq:      lastSeq,
+		nextFile: *db.nextFile,
+		removed:  nil,
+		added:    make([][]tableFile, numLevels),
+	}
+	edit.added[0] = added
+	err = logEdit(db, edit)
+	if err != nil {
+		db.tableL.Unlock()
+		db.bufferL.Unlock()
+		// the edit may still be in the manifest, so leave the file to
+		// recovery
+		closeTableFiles(added)
+		restoreBuffer(db, buf)
+		db.compactionL.Unlock()
+		return err
+	}
+	dropReadBufferOperands(db)
+	db.stats.mu.Lock()
+	db.stats.stats.Compactions = db.stats.stats.Compactions + 1
+	db.stats.mu.Unlock()
 	db.tableL.Unlock()
 
-	db.compactionL.Unlock()
-}
+	// the rbuffer is now just a cache for the part of the tables we just
+	// persisted
+	trimReadBuffer(db)
+	db.stall.compacted.Broadcast()
+	db.bufferL.Unlock()
+
+	// the old logs are now redundant with the tables
+	err = deleteOldLogs(db.dir, logNum)
 
-func recoverManifest() string {
-	f := filesys.Open("db", "manifest")
-	// need to know that table names are less than 4096 bytes
-	// (eventually we'll probably restrict ReadAt to read at most 4096 bytes
-	//  at a time due to it being atomic,
-	//  so checking the size of the file won't help,
-	//  and there's really no need for a loop here)
-	manifestData := filesys.ReadAt(f, 0, 4096)
-	tableName := string(manifestData)
-	filesys.Close(f)
-	return tableName
+	db.compactionL.Unlock()
+	err2 := mergeLevels(db)
+	if err != nil {
+		return err
+	}
+	return err2
 }
 
-// delete 'name' if it isn't tableName or "manifest"
-func deleteOtherFile(name string, tableName string) {
-	if name == tableName {
-		return
+// delete 'name' if it is a table or manifest file that isn't in keep
+//
+// The directory may be shared, so files that don't belong to the database are
+// left alone.
+func deleteOtherFile(d dbDir, name string, keep map[string]bool) error {
+	if keep[name] {
+		return nil
 	}
-	if name == "manifest" {
-		return
+	_, isTable := parseFileName("table.", name)
+	_, isManifest := parseFileName("manifest.", name)
+	if !isTable && !isManifest {
+		return nil
 	}
-	filesys.Delete("db", name)
+	return fsDelete(d, name)
 }
 
-func deleteOtherFiles(tableName string) {
-	files := filesys.List("db")
+func deleteOtherFiles(d dbDir, keep map[string]bool) error {
+	files, err := fsList(d)
+	if err != nil {
+		return err
+	}
 	nfiles := uint64(len(files))
 	for i := uint64(0); ; {
 		if i == nfiles {
 			break
 		}
 		name := files[i]
-		deleteOtherFile(name, tableName)
+		err := deleteOtherFile(d, name, keep)
+		if err != nil {
+			return err
+		}
 		i = i + 1
 		continue
 	}
+	return nil
 }
 
 // Recover restores a previously created database after a crash or shutdown.
-func Recover() Database {
-	tableName := recoverManifest()
-	table := RecoverTable(tableName)
-	tableRef := new(Table)
-	*tableRef = table
-	tableNameRef := new(string)
-	*tableNameRef = tableName
+//
+// Like NewDb, Recover uses the directory "db" on filesys.Fs.
+func Recover() (*Database, error) {
+	return RecoverWithOptions(DefaultOptions())
+}
 
-	deleteOtherFiles(tableName)
+// RecoverWithOptions restores a previously created database after a crash or
+// shutdown, using opts to configure it.
+func RecoverWithOptions(opts Options) (*Database, error) {
+	return recoverDb(defaultDir(), opts)
+}
+
+func recoverDb(d dbDir, opts Options) (*Database, error) {
+	err := checkOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	state, err := recoverManifest(d)
+	if err != nil {
+		return nil, err
+	}
+	lastSeq := state.seq
+	levels := state.levels
+	keep := make(map[string]bool)
+	var opened []tableFile
+	for _, level := range levels {
+		for i, t := range level {
+			table, err := recoverTable(d, t.name)
+			if err != nil {
+				closeTableFiles(opened)
+				return nil, err
+			}
+			level[i].table = table
+			opened = append(opened, level[i])
+			keep[t.name] = true
+		}
+	}
+	levelsRef := new([][]tableFile)
+	*levelsRef = levels
+	tableSeq := new(uint64)
+	*tableSeq = lastSeq
 
+	// files numbered nextFile or above were never installed (like a
+	// manifest that a crash left before switching CURRENT to it), so delete
+	// them before reusing their numbers
+	keep[state.name] = true
+	err = deleteOtherFiles(d, keep)
+	if err != nil {
+		closeTableFiles(opened)
+		return nil, err
+	}
+
+	// we can't append to the old manifest, so continue in a new one
+	nextFile := new(uint64)
+	*nextFile = state.nextFile + 1
+	m, err := createManifest(d, state.nextFile,
+		snapshotEdit(lastSeq, *nextFile, levels), opts.Sync != SyncNever)
+	if err != nil {
+		closeTableFiles(opened)
+		return nil, err
+	}
+	manifest := new(manifestWriter)
+	*manifest = m
+	// if this fails, the next recovery deletes the old manifest instead
+	fsDelete(d, state.name)
+
+	// replay the logs to recover writes that didn't make it to the tables
 	wbuffer := makeValueBuffer()
+	seq := new(uint64)
+	*seq = lastSeq
+	logs, err := listLogs(d)
+	if err != nil {
+		fsClose(d, m.file)
+		closeTableFiles(opened)
+		return nil, err
+	}
+	nextLog := uint64(0)
+	for _, n := range logs {
+		err := replayLog(d, n, *wbuffer, seq)
+		if err != nil {
+			fsClose(d, m.file)
+			closeTableFiles(opened)
+			return nil, err
+		}
+		nextLog = n + 1
+	}
+	// we can't append to an existing file, so continue in a new log
+	log, err := newLogWriter(d, nextLog, opts)
+	if err != nil {
+		fsClose(d, m.file)
+		closeTableFiles(opened)
+		return nil, err
+	}
+
 	rbuffer := makeValueBuffer()
 	bufferL := new(sync.RWMutex)
 	tableL := new(sync.RWMutex)
 	compactionL := new(sync.RWMutex)
 
-	return Database{
-		wbuffer:     wbuffer,
-		rbuffer:     rbuffer,
-		bufferL:     bufferL,
-		table:       tableRef,
-		tableName:   tableNameRef,
-		tableL:      tableL,
-		compactionL: compactionL,
+	wbufferBytes := new(uint64)
+	*wbufferBytes = bufferSize(*wbuffer)
+
+	db := &Database{
+		dir:           d,
+		wbuffer:       wbuffer,
+		wbufferBytes:  wbufferBytes,
+		rbuffer:       rbuffer,
+		rbufferBytes:  new(uint64),
+		rbufferPolicy: opts.ReadBuffer,
+		rbufferLimit:  opts.ReadBufferBytes,
+		seq:           seq,
+		snapshots:     make(map[uint64]uint64),
+		snapshotTimes: make(map[uint64]uint64),
+		merge:         opts.Merge,
+		clock:         optionsClock(opts),
+		bufferL:       bufferL,
+		stall:         newWriteStall(bufferL, opts),
+		log:           log,
+		levels:        levelsRef,
+		tableSeq:      tableSeq,
+		nextFile:      nextFile,
+		manifest:      manifest,
+		tableL:        tableL,
+		compactionL:   compactionL,
+		mergeL:        new(sync.Mutex),
+		mergePointers: make([][]byte, numLevels),
+		level0Tables:  opts.Level0Tables,
+		level1Bytes:   opts.Level1Bytes,
+		tableBytes:    opts.TableBytes,
+		tableOpts:     newDbTableOptions(opts),
+		cache:         newBlockCache(opts.BlockCacheBytes),
+		stats:         newDbStats(),
 	}
+	startCompactor(db, opts)
+	return db, nil
 }
 
 // Shutdown immediately closes the database.
 //
-// Discards any uncommitted in-memory writes; similar to a crash except for
-// cleanly closing any open files.
-func Shutdown(db Database) {
-	db.bufferL.Lock()
+// Similar to a crash except for cleanly closing any open files; in-memory
+// writes are recovered from the log.
+//
+// Shutdown first waits for a running background compaction to finish. If the
+// last background compaction failed, Shutdown returns its error.
+func Shutdown(db *Database) error {
+	err := stopCompactor(db.compactor)
+
+	// in the same order as Compact and mergeLevels take them
 	db.compactionL.Lock()
+	db.mergeL.Lock()
+	db.bufferL.Lock()
 
-	t := *db.table
-	CloseTable(t)
+	var err2 error
+	for _, level := range *db.levels {
+		for _, t := range level {
+			err4 := retireTable(t.table)
+			if err2 == nil {
+				err2 = err4
+			}
+		}
+	}
+	err3 := logClose(db.log)
+	db.tableL.Lock()
+	err5 := fsClose(db.dir, db.manifest.file)
+	db.tableL.Unlock()
+	if err3 == nil {
+		err3 = err5
+	}
 
-	db.compactionL.Unlock()
 	db.bufferL.Unlock()
+	db.mergeL.Unlock()
+	db.compactionL.Unlock()
+	if err != nil {
+		return err
+	}
+	if err2 != nil {
+		return err2
+	}
+	return err3
 }
 
 // Close closes an open database cleanly, flushing any in-memory writes.
 //
-// db should not be used afterward
-func Close(db Database) {
-	Compact(db)
-	Shutdown(db)
+// db should not be used afterward, even if Close fails; a failed compaction
+// leaves the writes in the log for Recover.
+func Close(db *Database) error {
+	err := Compact(db)
+	err2 := Shutdown(db)
+	if err != nil {
+		return err
+	}
+	return err2
 }
@@ -1,7 +1,11 @@
 package simpledb
 
 import (
+	"bytes"
+	"encoding/binary"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -22,10 +26,8 @@ func readFile(p string) (data []byte) {
 
 func TestEntryEncoding(t *testing.T) {
 	assert := assert.New(t)
-	e := Entry{Key: 3, Value: []byte("value")}
-	var buf []byte
-	buf = EncodeUInt64(e.Key, buf)
-	buf = EncodeSlice(e.Value, buf)
+	e := Entry{Key: []byte("key"), Value: []byte("value")}
+	buf := EncodeEntry(e, nil)
 
 	decoded, l := DecodeEntry(buf)
 	assert.Equal(uint64(len(buf)), l)
@@ -33,10 +35,8 @@ func TestEntryEncoding(t *testing.T) {
 }
 
 func TestEntryEncodingShort(t *testing.T) {
-	e := Entry{Key: 3, Value: []byte("value")}
-	var buf []byte
-	buf = EncodeUInt64(e.Key, buf)
-	buf = EncodeSlice(e.Value, buf)
+	e := Entry{Key: []byte("key"), Value: []byte("value")}
+	buf := EncodeEntry(e, nil)
 
 	_, l := DecodeEntry(buf[:len(buf)-1])
 	assert.Equal(t, uint64(0), l)
@@ -57,22 +57,32 @@ func (suite *SimpleDbSuite) SetupTest() {
 
 func (suite *SimpleDbSuite) TestBufFile() {
 	testFile, _ := filesys.Create("db", "test")
-	f := newBuf(testFile)
+	f := newBuf(defaultDir(), testFile)
 	bufAppend(f, []byte("hello "))
 	bufAppend(f, []byte("world"))
 	bufFlush(f)
 	bufAppend(f, []byte("!"))
-	bufClose(f)
+	bufClose(f, false)
 	suite.Equal([]byte("hello world!"), readFile("test"))
 }
 
+// key encodes n as a key, big-endian so that keys sort numerically
+func key(n uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, n)
+	return k
+}
+
 type maybeValue struct {
 	value   []byte
 	present bool
 }
 
-func tblRead(t Table, k uint64) maybeValue {
-	v, ok := tableRead(t, k)
+func tblRead(t Table, k []byte) maybeValue {
+	v, ok, err := tableRead(nil, t, k, latestSeq)
+	if err != nil {
+		panic(err)
+	}
 	return maybeValue{value: v, present: ok}
 }
 
@@ -90,119 +100,456 @@ func present(v string) maybeValue {
 }
 
 func (suite *SimpleDbSuite) TestTableWriter() {
-	w := newTableWriter("table")
-	tablePut(w, 1, []byte("v1"))
-	tablePut(w, 10, []byte("value ten"))
-	tablePut(w, 2, []byte("v two"))
-	t := tableWriterClose(w)
-	suite.Equal(present("v1"), tblRead(t, 1))
-	suite.Equal(present("v two"), tblRead(t, 2))
-	suite.Equal(present("value ten"), tblRead(t, 10))
+	w, _ := newTableWriter(defaultDir(), "table", tableOptions{})
+	tablePut(w, key(1), 1, []byte("v1"))
+	tablePut(w, key(2), 1, []byte("v two"))
+	tablePut(w, key(10), 1, []byte("value ten"))
+	t, _ := tableWriterClose(w)
+	suite.Equal(present("v1"), tblRead(t, key(1)))
+	suite.Equal(present("v two"), tblRead(t, key(2)))
+	suite.Equal(present("value ten"), tblRead(t, key(10)))
+	suite.Equal(missing, tblRead(t, key(0)))
+	suite.Equal(missing, tblRead(t, key(3)))
+	suite.Equal(missing, tblRead(t, key(11)))
+}
+
+func (suite *SimpleDbSuite) TestTableWriterUnsorted() {
+	w, _ := newTableWriter(defaultDir(), "table", tableOptions{})
+	tablePut(w, key(2), 1, []byte("v two"))
+	suite.Panics(func() { tablePut(w, key(1), 1, []byte("v1")) })
+	suite.Panics(func() { tablePut(w, key(2), 1, []byte("v two")) })
+}
+
+func (suite *SimpleDbSuite) TestTableBlocks() {
+	w, _ := newTableWriter(defaultDir(), "table", tableOptions{})
+	for k := uint64(0); k < 1000; k++ {
+		tablePut(w, key(2*k), 1, []byte("value"))
+	}
+	tmp, _ := tableWriterClose(w)
+	suite.True(len(tmp.Index) > 1, "table should have multiple blocks")
+	CloseTable(tmp)
+
+	t, _ := RecoverTable(filesys.Fs, "db", "table")
+	suite.Equal(tmp.Index, t.Index)
+	for k := uint64(0); k < 1000; k++ {
+		suite.Equal(present("value"), tblRead(t, key(2*k)))
+		suite.Equal(missing, tblRead(t, key(2*k+1)))
+	}
+}
+
+func writeFile(p string, data []byte) {
+	f, _ := filesys.Create("db", p)
+	filesys.Append(f, data)
+	filesys.Close(f)
+}
+
+func (suite *SimpleDbSuite) TestTableIndexFallback() {
+	w, _ := newTableWriter(defaultDir(), "table", tableOptions{})
+	for k := uint64(0); k < 1000; k++ {
+		tablePut(w, key(k), 1, []byte("value"))
+	}
+	tmp, _ := tableWriterClose(w)
+	CloseTable(tmp)
+	data := readFile("table")
+	indexOffset := tmp.Index[len(tmp.Index)-1].Offset +
+		tmp.Index[len(tmp.Index)-1].Length
+
+	f := filesys.Open("db", "table")
+	_, _, ok, err := readTableIndex(defaultDir(), f)
+	suite.NoError(err)
+	filesys.Close(f)
+	suite.True(ok, "intact footer should be used")
+
+	corruptIndex := append([]byte{}, data...)
+	corruptIndex[indexOffset+20]++
+	// the high byte of the trailer's numBlocks
+	hugeNumBlocks := append([]byte{}, data...)
+	hugeNumBlocks[len(data)-int(trailerSize)+16+7] = 0xff
+	damaged := map[string][]byte{
+		"no trailer":     data[:len(data)-int(trailerSize)],
+		"no footer":      data[:indexOffset],
+		"corrupt index":  corruptIndex,
+		"huge numBlocks": hugeNumBlocks,
+	}
+	for name, p := range damaged {
+		writeFile(name, p)
+		f := filesys.Open("db", name)
+		_, _, ok, err := readTableIndex(defaultDir(), f)
+		suite.NoError(err)
+		filesys.Close(f)
+		suite.False(ok, "%s: footer should be rejected", name)
+
+		t, _ := RecoverTable(filesys.Fs, "db", name)
+		suite.Equal(tmp.Index, t.Index, name)
+		suite.Equal(present("value"), tblRead(t, key(500)), name)
+		CloseTable(t)
+	}
+}
+
+func (suite *SimpleDbSuite) TestScanDamagedBlockLength() {
+	w, _ := newTableWriter(defaultDir(), "table", tableOptions{})
+	for k := uint64(0); k < 1000; k++ {
+		tablePut(w, key(k), 1, []byte("value"))
+	}
+	tmp, _ := tableWriterClose(w)
+	CloseTable(tmp)
+	data := readFile("table")
+	b := tmp.Index[1]
+
+	// without a footer, the scan has to trust the block headers
+	p := append([]byte{}, data[:len(data)-int(trailerSize)]...)
+	p[b.Offset+16+7] = 0xff
+	writeFile("damaged", p)
+	t, err := RecoverTable(filesys.Fs, "db", "damaged")
+	suite.Require().NoError(err)
+	suite.Equal(2, len(t.Index))
+	suite.Equal(present("value"), tblRead(t, tmp.Index[0].FirstKey))
+	_, _, err = tableRead(nil, t, b.FirstKey, latestSeq)
+	suite.Equal(ErrCorrupt, err)
+	CloseTable(t)
+}
+
+func (suite *SimpleDbSuite) TestEmptyTable() {
+	tmp, _ := CreateTable(filesys.Fs, "db", "table")
+	CloseTable(tmp)
+	t, _ := RecoverTable(filesys.Fs, "db", "table")
+	suite.Equal(0, len(t.Index))
+	suite.Equal(missing, tblRead(t, key(0)))
+}
+
+func (suite *SimpleDbSuite) TestFileSize() {
+	for _, size := range []int{0, 1, 4095, 4096, 4097, 10000} {
+		f, _ := filesys.Create("db", "file")
+		filesys.Append(f, make([]byte, size))
+		filesys.Close(f)
+		f = filesys.Open("db", "file")
+		n, err := fileSize(defaultDir(), f)
+		suite.NoError(err)
+		suite.Equal(uint64(size), n)
+		filesys.Close(f)
+		filesys.Delete("db", "file")
+	}
 }
 
 func (suite *SimpleDbSuite) TestTableWriterLargeValue() {
-	w := newTableWriter("table")
+	w, _ := newTableWriter(defaultDir(), "table", tableOptions{})
 	data := make([]byte, 5000)
 	for i := range data {
 		data[i] = byte(i % 10)
 	}
-	tablePut(w, 1, data)
-	t := tableWriterClose(w)
-	suite.Equal(bytesPresent(data), tblRead(t, 1))
+	tablePut(w, key(1), 1, data)
+	t, _ := tableWriterClose(w)
+	suite.Equal(bytesPresent(data), tblRead(t, key(1)))
 }
 
 func (suite *SimpleDbSuite) TestTableRecovery() {
-	w := newTableWriter("table")
-	tablePut(w, 1, []byte("v1"))
-	tablePut(w, 10, []byte("value ten"))
-	tablePut(w, 2, []byte("v two"))
-	tmp := tableWriterClose(w)
+	w, _ := newTableWriter(defaultDir(), "table", tableOptions{})
+	tablePut(w, key(1), 1, []byte("v1"))
+	tablePut(w, key(2), 1, []byte("v two"))
+	tablePut(w, key(10), 1, []byte("value ten"))
+	tmp, _ := tableWriterClose(w)
 	CloseTable(tmp)
 
-	tbl := RecoverTable("table")
-	suite.Equal(present("v1"), tblRead(tbl, 1))
-	suite.Equal(present("v two"), tblRead(tbl, 2))
-	suite.Equal(present("value ten"), tblRead(tbl, 10))
+	tbl, _ := RecoverTable(filesys.Fs, "db", "table")
+	suite.Equal(present("v1"), tblRead(tbl, key(1)))
+	suite.Equal(present("v two"), tblRead(tbl, key(2)))
+	suite.Equal(present("value ten"), tblRead(tbl, key(10)))
 }
 
-func dbRead(db Database, k uint64) maybeValue {
-	v, ok := Read(db, k)
+func mustDb(db *Database, err error) *Database {
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+func dbRead(db *Database, k []byte) maybeValue {
+	v, ok, err := Read(db, k)
+	if err != nil {
+		panic(err)
+	}
 	return maybeValue{value: v, present: ok}
 }
 
 func (suite *SimpleDbSuite) TestReadWrite() {
-	db := NewDb()
-	suite.Equal(missing, dbRead(db, 1))
-	Write(db, 1, []byte("v1"))
-	Write(db, 2, []byte("value 2"))
-	suite.Equal(present("v1"), dbRead(db, 1))
-	suite.Equal(present("value 2"), dbRead(db, 2))
+	db := mustDb(NewDb())
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Write(db, key(2), []byte("value 2")))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
 }
 
 func (suite *SimpleDbSuite) TestCompact() {
-	db := NewDb()
-	suite.Equal(missing, dbRead(db, 1))
-	Write(db, 1, []byte("v1"))
-	Compact(db)
-	Compact(db)
-	Write(db, 2, []byte("value 2"))
-	suite.Equal(present("v1"), dbRead(db, 1))
-	suite.Equal(present("value 2"), dbRead(db, 2))
+	db := mustDb(NewDb())
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(2), []byte("value 2")))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
 }
 
 func (suite *SimpleDbSuite) TestRecover() {
-	db := NewDb()
-	suite.Equal(missing, dbRead(db, 1))
-	Write(db, 1, []byte("v1"))
-	Compact(db)
-	Compact(db)
-	Write(db, 2, []byte("value 2"))
-	Shutdown(db)
-	db = Recover()
-	suite.Equal(present("v1"), dbRead(db, 1))
-	suite.Equal(missing, dbRead(db, 2))
+	db := mustDb(NewDb())
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(2), []byte("value 2")))
+	suite.NoError(Shutdown(db))
+	db = mustDb(Recover())
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
+}
+
+func TestOpenIndependentDbs(t *testing.T) {
+	assert := assert.New(t)
+	fs := filesys.NewMemFs()
+	fs.Mkdir("a")
+	fs.Mkdir("b")
+	dbs := []*Database{
+		mustDb(Open(fs, "a", DefaultOptions())),
+		mustDb(Open(fs, "b", DefaultOptions())),
+	}
+	var wg sync.WaitGroup
+	for i, db := range dbs {
+		wg.Add(1)
+		go func(i int, db *Database) {
+			defer wg.Done()
+			for k := uint64(0); k < 100; k++ {
+				assert.NoError(Write(db, key(k), []byte{byte(i)}))
+			}
+			assert.NoError(Compact(db))
+			assert.NoError(Close(db))
+		}(i, db)
+	}
+	wg.Wait()
+
+	for i, dir := range []string{"a", "b"} {
+		db := mustDb(Open(fs, dir, DefaultOptions()))
+		v, ok, err := Read(db, key(50))
+		assert.NoError(err)
+		assert.True(ok)
+		assert.Equal([]byte{byte(i)}, v, dir)
+		assert.NoError(Shutdown(db))
+	}
+}
+
+func (suite *SimpleDbSuite) TestOpenRecovers() {
+	db := mustDb(Open(filesys.Fs, "db", DefaultOptions()))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Shutdown(db))
+	db = mustDb(Open(filesys.Fs, "db", DefaultOptions()))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestOpenSharedDir() {
+	others := []string{"notes.txt", "table", "table.backup", "manifest.old"}
+	for _, name := range others {
+		writeFile(name, []byte(name))
+	}
+	db := mustDb(Open(filesys.Fs, "db", DefaultOptions()))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.NoError(Shutdown(db))
+	db = mustDb(Open(filesys.Fs, "db", DefaultOptions()))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.NoError(Shutdown(db))
+	for _, name := range others {
+		suite.Equal([]byte(name), readFile(name), "%s should be kept", name)
+	}
 }
 
 func (suite *SimpleDbSuite) TestClose() {
-	db := NewDb()
-	suite.Equal(missing, dbRead(db, 1))
-	Write(db, 1, []byte("v1"))
-	Compact(db)
-	Compact(db)
-	Write(db, 2, []byte("value 2"))
-	Close(db)
-	db = Recover()
-	suite.Equal(present("v1"), dbRead(db, 1))
-	suite.Equal(present("value 2"), dbRead(db, 2))
+	db := mustDb(NewDb())
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(2), []byte("value 2")))
+	suite.NoError(Close(db))
+	db = mustDb(Recover())
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestShutdownDuringCompaction() {
+	db := mustDb(NewDbWithOptions(noCompactionOptions()))
+	// in the middle of a compaction and a merge, which go on to take bufferL
+	db.compactionL.Lock()
+	db.mergeL.Lock()
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- Shutdown(db)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	locked := make(chan bool)
+	go func() {
+		db.bufferL.Lock()
+		db.bufferL.Unlock()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		suite.FailNow("Shutdown deadlocked with a compaction")
+	}
+	db.mergeL.Unlock()
+	db.compactionL.Unlock()
+	suite.NoError(<-shutdown)
 }
 
 func (suite *SimpleDbSuite) TestReadBuffer() {
-	db := NewDb()
-	Write(db, 1, []byte("v1"))
-	Compact(db)
-	suite.Equal(present("v1"), dbRead(db, 1))
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
 }
 
 func (suite *SimpleDbSuite) TestReadLargeValue() {
-	db := NewDb()
+	db := mustDb(NewDb())
 	data := make([]byte, 5000)
 	for i := range data {
 		data[i] = byte(i % 10)
 	}
-	Write(db, 1, data)
-	Compact(db)
-	Compact(db)
-	suite.Equal(bytesPresent(data), dbRead(db, 1))
+	suite.NoError(Write(db, key(1), data))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.Equal(bytesPresent(data), dbRead(db, key(1)))
 }
 
 func (suite *SimpleDbSuite) TestRecoverLargeValue() {
-	db := NewDb()
+	db := mustDb(NewDb())
 	data := make([]byte, 5000)
 	for i := range data {
 		data[i] = byte(i % 10)
 	}
-	Write(db, 1, data)
-	Close(db)
-	db = Recover()
-	suite.Equal(bytesPresent(data), dbRead(db, 1))
+	suite.NoError(Write(db, key(1), data))
+	suite.NoError(Close(db))
+	db = mustDb(Recover())
+	suite.Equal(bytesPresent(data), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestDelete() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Write(db, key(2), []byte("value 2")))
+	suite.NoError(Delete(db, key(1)))
+	suite.NoError(Delete(db, key(3)))
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
+	suite.Equal(missing, dbRead(db, key(3)))
+	suite.NoError(Write(db, key(1), []byte("v1 again")))
+	suite.Equal(present("v1 again"), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestDeleteCompact() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Write(db, key(2), []byte("value 2")))
+	suite.NoError(Compact(db))
+	suite.NoError(Delete(db, key(1)))
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.NoError(Compact(db))
+	suite.Equal(missing, dbRead(db, key(1)), "tombstone in read buffer")
+	suite.NoError(Compact(db))
+	suite.Equal(missing, dbRead(db, key(1)), "key dropped from table")
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestDeleteRecover() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Write(db, key(2), []byte("value 2")))
+	suite.NoError(Compact(db))
+	suite.NoError(Delete(db, key(1)))
+	suite.NoError(Close(db))
+	db = mustDb(Recover())
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.Equal(present("value 2"), dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestWriteEmptyValue() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), nil))
+	suite.Equal(present(""), dbRead(db, key(1)))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.Equal(present(""), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestVariableLengthKeys() {
+	db := mustDb(NewDb())
+	var keys [][]byte
+	for i := 0; i < 500; i++ {
+		keys = append(keys, bytes.Repeat([]byte{byte(i)}, i%20))
+	}
+	for i, k := range keys {
+		suite.NoError(Write(db, k, []byte{byte(i)}))
+	}
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.NoError(Shutdown(db))
+	db = mustDb(Recover())
+	// later writes of a repeated key win
+	last := make(map[string]byte)
+	for i, k := range keys {
+		last[string(k)] = byte(i)
+	}
+	for k, v := range last {
+		suite.Equal(bytesPresent([]byte{v}), dbRead(db, []byte(k)))
+	}
+	suite.Equal(missing, dbRead(db, []byte("missing")))
+}
+
+func (suite *SimpleDbSuite) TestTableCorruption() {
+	w, _ := newTableWriter(defaultDir(), "table", tableOptions{})
+	for k := uint64(0); k < 1000; k++ {
+		tablePut(w, key(k), 1, []byte("value"))
+	}
+	tmp, _ := tableWriterClose(w)
+	CloseTable(tmp)
+	data := readFile("table")
+	b := tmp.Index[1]
+
+	flipped := append([]byte{}, data...)
+	flipped[b.Offset+b.Length-1] ^= 1
+	writeFile("flipped", flipped)
+	t, _ := RecoverTable(filesys.Fs, "db", "flipped")
+	_, _, err := tableRead(nil, t, b.FirstKey, latestSeq)
+	suite.Equal(ErrCorrupt, err, "bit flip in a value")
+	suite.Equal(present("value"), tblRead(t, tmp.Index[0].FirstKey),
+		"other blocks are still readable")
+	CloseTable(t)
+
+	writeFile("truncated", data[:b.Offset+b.Length-1])
+	t, _ = RecoverTable(filesys.Fs, "db", "truncated")
+	suite.Equal(2, len(t.Index))
+	_, _, err = tableRead(nil, t, b.FirstKey, latestSeq)
+	suite.Equal(ErrCorrupt, err, "truncated block")
+	CloseTable(t)
+}
+
+func (suite *SimpleDbSuite) TestReadCorruption() {
+	db := mustDb(NewDb())
+	for k := uint64(0); k < 1000; k++ {
+		suite.NoError(Write(db, key(k), []byte("value")))
+	}
+	suite.NoError(Close(db))
+	state, _ := recoverManifest(defaultDir())
+	name := state.levels[0][0].name
+	data := readFile(name)
+	data[100] ^= 1
+	filesys.Delete("db", name)
+	writeFile(name, data)
+
+	db = mustDb(Recover())
+	_, _, err := Read(db, key(0))
+	suite.Equal(ErrCorrupt, err)
+	it := NewIterator(db, key(0), key(1000))
+	suite.False(it.Valid())
+	suite.Equal(ErrCorrupt, it.Err())
+	it.Close()
 }
@@ -0,0 +1,75 @@
+package simpledb
+
+// A snapshot is a consistent view of the database at one point in time.
+//
+// A snapshot is just a sequence number: it sees the writes up to that number
+// and none after (see mvcc.go). It also records the time it was taken, and
+// writes with a TTL expire as of that time, so that they don't disappear from
+// the snapshot one by one. While the snapshot is open, the database keeps the
+// versions it sees, in the buffers and across compactions; Close lets them be
+// dropped.
+
+// A DbSnapshot is a read-only view of a database as of a call to Snapshot.
+//
+// Read and NewIterator are safe to call concurrently. Call Close when done
+// with the snapshot so the database can drop the old versions it sees.
+type DbSnapshot struct {
+	db  *Database
+	seq uint64
+	// the time the snapshot was taken
+	now    uint64
+	closed bool
+}
+
+// Snapshot returns a view of db that sees all writes completed so far and
+// none that come later.
+func Snapshot(db *Database) *DbSnapshot {
+	db.bufferL.Lock()
+	seq := *db.seq
+	now := clockNow(db)
+	if db.snapshots[seq] == 0 {
+		db.snapshotTimes[seq] = now
+	}
+	db.snapshots[seq] = db.snapshots[seq] + 1
+	db.bufferL.Unlock()
+	return &DbSnapshot{
+		db:     db,
+		seq:    seq,
+		now:    now,
+		closed: false,
+	}
+}
+
+// Read gets the value of k as of the snapshot. Errors are as for Read.
+func (s *DbSnapshot) Read(k []byte) ([]byte, bool, error) {
+	return readAt(s.db, k, s.seq, s.now)
+}
+
+// NewIterator creates an iterator over the keys in [start, end] as of the
+// snapshot, like the database's NewIterator.
+//
+// The iterator holds on to the data it reads, so it may outlive the
+// snapshot.
+func (s *DbSnapshot) NewIterator(start []byte, end []byte) *Iterator {
+	return newIteratorAt(s.db, start, end, s.seq, s.now)
+}
+
+// Close releases the snapshot. The snapshot must not be used afterward, but
+// iterators created from it remain valid.
+func (s *DbSnapshot) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	db := s.db
+	db.bufferL.Lock()
+	n := db.snapshots[s.seq] - 1
+	if n == 0 {
+		delete(db.snapshots, s.seq)
+		delete(db.snapshotTimes, s.seq)
+	} else {
+		db.snapshots[s.seq] = n
+	}
+	db.bufferL.Unlock()
+	return nil
+}
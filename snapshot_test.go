@@ -0,0 +1,106 @@
+package simpledb
+
+func (suite *SimpleDbSuite) snapRead(s *DbSnapshot, k []byte) maybeValue {
+	v, ok, err := s.Read(k)
+	suite.Require().NoError(err)
+	return maybeValue{value: v, present: ok}
+}
+
+// tableEntries counts the entries (including old versions and deletions) in
+// db's table
+func (suite *SimpleDbSuite) tableEntries(db *Database) int {
+	n := 0
+	for _, level := range *db.levels {
+		for _, t := range level {
+			it := newTableIter(t.table)
+			tableIterSeek(it, nil)
+			for ; tableIterValid(it); tableIterNext(it) {
+				n++
+			}
+			suite.NoError(tableIterErr(it))
+		}
+	}
+	return n
+}
+
+func (suite *SimpleDbSuite) TestSnapshotRead() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("table 1")))
+	suite.NoError(Write(db, key(2), []byte("table 2")))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(2), []byte("rbuf 2")))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(3), []byte("wbuf 3")))
+	suite.NoError(Delete(db, key(1)))
+
+	s := Snapshot(db)
+	defer s.Close()
+	suite.NoError(Write(db, key(1), []byte("new 1")))
+	suite.NoError(Delete(db, key(2)))
+	suite.NoError(Write(db, key(4), []byte("new 4")))
+	suite.Equal(missing, suite.snapRead(s, key(1)))
+	suite.Equal(present("rbuf 2"), suite.snapRead(s, key(2)))
+	suite.Equal(present("wbuf 3"), suite.snapRead(s, key(3)))
+	suite.Equal(missing, suite.snapRead(s, key(4)))
+	suite.Equal(present("new 1"), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestSnapshotAcrossCompactions() {
+	db := mustDb(NewDb())
+	for k := uint64(0); k < 100; k++ {
+		suite.NoError(Write(db, key(k), []byte("old")))
+	}
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	s := Snapshot(db)
+	for k := uint64(0); k < 100; k++ {
+		suite.NoError(Write(db, key(k), []byte("new")))
+	}
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	for k := uint64(0); k < 100; k++ {
+		suite.Equal(present("old"), suite.snapRead(s, key(k)))
+		suite.Equal(present("new"), dbRead(db, key(k)))
+	}
+	suite.Equal(200, suite.tableEntries(db),
+		"the table should keep the old versions")
+	suite.NoError(s.Close())
+	suite.NoError(s.Close(), "closing twice should be harmless")
+	suite.NoError(CompactAll(db))
+	suite.Equal(100, suite.tableEntries(db),
+		"the old versions should be dropped")
+}
+
+func (suite *SimpleDbSuite) TestSnapshotIterator() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Write(db, key(2), []byte("v2")))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.NoError(Write(db, key(3), []byte("v3")))
+	s := Snapshot(db)
+	suite.NoError(Delete(db, key(1)))
+	suite.NoError(Write(db, key(4), []byte("v4")))
+	suite.NoError(Compact(db))
+
+	it := s.NewIterator(nil, nil)
+	// the iterator keeps the table open on its own
+	suite.NoError(s.Close())
+	suite.Equal([]kv{
+		{key(1), "v1"},
+		{key(2), "v2"},
+		{key(3), "v3"},
+	}, iterAll(it))
+	suite.NoError(it.Err())
+	suite.NoError(it.Close())
+
+	it = NewIterator(db, nil, nil)
+	defer it.Close()
+	suite.Equal([]kv{
+		{key(2), "v2"},
+		{key(3), "v3"},
+		{key(4), "v4"},
+	}, iterAll(it))
+}
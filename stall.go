@@ -0,0 +1,91 @@
+package simpledb
+
+import (
+	"sync"
+	"time"
+)
+
+// Writes stall to keep the buffers within a memory budget.
+//
+// Once the write and read buffers together reach Options.BufferSoftLimit
+// bytes, each write is delayed by slowdownDelay, which gives compaction a
+// chance to catch up without blocking writers outright. At
+// Options.BufferHardLimit writes block until a compaction installs a new
+// table; with no background compactor, that requires a call to Compact.
+
+// slowdownDelay is how long a write waits past the soft limit
+const slowdownDelay = time.Millisecond
+
+type writeStall struct {
+	softLimit uint64
+	hardLimit uint64
+	// signalled (with bufferL as its lock) when a compaction installs a new
+	// table or gives up, freeing up buffer memory
+	compacted *sync.Cond
+}
+
+func newWriteStall(bufferL *sync.RWMutex, opts Options) *writeStall {
+	return &writeStall{
+		softLimit: opts.BufferSoftLimit,
+		hardLimit: opts.BufferHardLimit,
+		compacted: sync.NewCond(bufferL),
+	}
+}
+
+// bufferMemory is the number of bytes held by the buffers.
+//
+// Assumes bufferL is held.
+func bufferMemory(db *Database) uint64 {
+	return *db.wbufferBytes + *db.rbufferBytes
+}
+
+func overLimit(db *Database, limit uint64) bool {
+	return limit > 0 && bufferMemory(db) >= limit
+}
+
+// writesStalled reports whether writes are being slowed down or blocked.
+//
+// Assumes bufferL is held.
+func writesStalled(db *Database) bool {
+	return overLimit(db, db.stall.softLimit) ||
+		overLimit(db, db.stall.hardLimit)
+}
+
+// stallWrite delays a write until the buffers have room for it, and then
+// returns the log's failure, if any: once the log fails, writes are rejected
+// before they are buffered.
+//
+// Assumes bufferL is held for writing; it is released while waiting.
+func stallWrite(db *Database) error {
+	s := db.stall
+	if overLimit(db, s.softLimit) && !overLimit(db, s.hardLimit) {
+		compactSoon(db.compactor)
+		db.bufferL.Unlock()
+		start := time.Now()
+		time.Sleep(slowdownDelay)
+		recordStall(db, false, time.Since(start))
+		db.bufferL.Lock()
+	}
+	if overLimit(db, s.hardLimit) {
+		start := time.Now()
+		// compactions can't succeed once the log has failed
+		for overLimit(db, s.hardLimit) && logErr(db.log) == nil {
+			compactSoon(db.compactor)
+			s.compacted.Wait()
+		}
+		recordStall(db, true, time.Since(start))
+	}
+	return logErr(db.log)
+}
+
+func recordStall(db *Database, stopped bool, d time.Duration) {
+	db.stats.mu.Lock()
+	if stopped {
+		db.stats.stats.WriteStops = db.stats.stats.WriteStops + 1
+		db.stats.stats.WriteStopTime = db.stats.stats.WriteStopTime + d
+	} else {
+		db.stats.stats.WriteSlowdowns = db.stats.stats.WriteSlowdowns + 1
+		db.stats.stats.WriteSlowdownTime = db.stats.stats.WriteSlowdownTime + d
+	}
+	db.stats.mu.Unlock()
+}
@@ -0,0 +1,72 @@
+package simpledb
+
+import (
+	"time"
+)
+
+func noCompactionOptions() Options {
+	opts := DefaultOptions()
+	opts.CompactBufferBytes = 0
+	opts.CompactBufferKeys = 0
+	return opts
+}
+
+func (suite *SimpleDbSuite) TestWriteSlowdown() {
+	opts := noCompactionOptions()
+	opts.BufferSoftLimit = 1000
+	opts.BufferHardLimit = 0
+	db := mustDb(NewDbWithOptions(opts))
+	for k := uint64(0); k < 20; k++ {
+		suite.NoError(Write(db, key(k), make([]byte, 100)))
+	}
+	stats := GetStats(db)
+	// the first 10 writes fit under the limit
+	suite.Equal(uint64(10), stats.WriteSlowdowns)
+	suite.True(stats.WriteSlowdownTime >= 10*slowdownDelay)
+	suite.Equal(uint64(0), stats.WriteStops)
+}
+
+func (suite *SimpleDbSuite) TestWriteStop() {
+	opts := noCompactionOptions()
+	opts.BufferSoftLimit = 0
+	opts.BufferHardLimit = 1000
+	db := mustDb(NewDbWithOptions(opts))
+	for k := uint64(0); k < 10; k++ {
+		suite.NoError(Write(db, key(k), make([]byte, 100)))
+	}
+	done := make(chan error)
+	go func() {
+		done <- Write(db, key(10), []byte("v10"))
+	}()
+	select {
+	case <-done:
+		suite.FailNow("write should block at the hard limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	suite.NoError(Compact(db))
+	suite.NoError(<-done)
+	suite.Equal(present("v10"), dbRead(db, key(10)))
+	stats := GetStats(db)
+	suite.Equal(uint64(1), stats.WriteStops)
+	suite.True(stats.WriteStopTime >= 20*time.Millisecond)
+}
+
+func (suite *SimpleDbSuite) TestWriteStopBackgroundCompaction() {
+	opts := DefaultOptions()
+	// the compactor only runs for stalled writes
+	opts.CompactBufferBytes = 0
+	opts.CompactBufferKeys = 1000000
+	opts.BufferSoftLimit = 500
+	opts.BufferHardLimit = 1000
+	db := mustDb(NewDbWithOptions(opts))
+	for k := uint64(0); k < 100; k++ {
+		suite.NoError(Write(db, key(k), make([]byte, 100)))
+	}
+	suite.True(GetStats(db).Compactions > 0)
+	db.bufferL.RLock()
+	suite.True(bufferMemory(db) < opts.BufferHardLimit)
+	db.bufferL.RUnlock()
+	suite.NoError(Close(db))
+	db = mustDb(RecoverWithOptions(opts))
+	suite.Equal(bytesPresent(make([]byte, 100)), dbRead(db, key(99)))
+}
@@ -0,0 +1,51 @@
+package simpledb
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats are counters for a database's activity since it was opened.
+type Stats struct {
+	// Compactions is the number of completed compactions, whether run by
+	// Compact or in the background.
+	Compactions uint64
+	// LevelMerges is the number of merges of a level into the next one.
+	LevelMerges uint64
+	// WriteSlowdowns counts writes delayed by the soft buffer limit, and
+	// WriteSlowdownTime is the total time they were delayed.
+	WriteSlowdowns    uint64
+	WriteSlowdownTime time.Duration
+	// WriteStops counts writes blocked by the hard buffer limit, and
+	// WriteStopTime is the total time they were blocked.
+	WriteStops    uint64
+	WriteStopTime time.Duration
+	// BlockCacheHits and BlockCacheMisses count table reads that did and
+	// didn't find their block in the block cache.
+	BlockCacheHits   uint64
+	BlockCacheMisses uint64
+}
+
+type dbStats struct {
+	mu    *sync.Mutex
+	stats Stats
+}
+
+func newDbStats() *dbStats {
+	return &dbStats{mu: new(sync.Mutex)}
+}
+
+// GetStats returns a snapshot of db's counters.
+func GetStats(db *Database) Stats {
+	db.stats.mu.Lock()
+	s := db.stats.stats
+	db.stats.mu.Unlock()
+	c := db.cache
+	if c != nil {
+		c.mu.Lock()
+		s.BlockCacheHits = c.hits
+		s.BlockCacheMisses = c.misses
+		c.mu.Unlock()
+	}
+	return s
+}
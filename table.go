@@ -0,0 +1,495 @@
+package simpledb
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"sort"
+
+	"github.com/tchajed/goose/machine/filesys"
+)
+
+// Table file format:
+//
+//	table   := header block* filter? index trailer
+//	header  := headerKind(u64) codec(u64)
+//	block   := blockKind(u64) checksum(u64) len(u64) entry*
+//	         | compressedBlockKind(u64) checksum(u64) len(u64) compressed
+//	entry   := key(slice) tag(u64) value(slice)
+//	index   := indexKind(u64) len(u64) handle*
+//	handle  := firstKey(slice) offset(u64) length(u64)
+//	trailer := filterOffset(u64) indexOffset(u64) numBlocks(u64)
+//	           indexChecksum(u64) magic(u64)
+//	slice   := len(u64) byte*
+//
+// Entries are sorted by key, comparing keys lexicographically as bytes, across
+// the whole table, and the versions of a key from newest to oldest. An
+// entry's tag holds its sequence number and whether it is a deletion (see
+// EncodeEntry). Blocks are filled up to about blockSize bytes; neither an
+// entry nor the versions of a key span blocks, so a block with a large value
+// can be bigger.
+//
+// The header records the codec that compressed blocks use (see Compression);
+// a compressed block holds its encoded entries compressed with it.
+//
+// Checksums are CRC32C (Castagnoli) and cover the entries of a block as
+// stored (so compressed, for a compressed block) or the handles of the index.
+// The filter is a Bloom filter over the table's keys (see bloom.go); a table
+// without one has filterOffset = indexOffset.
+//
+// The index and fixed-size trailer let a table be opened without reading its
+// data. The kind tags make the blocks self-describing, so if the footer is
+// damaged the index can still be rebuilt by walking the blocks.
+
+// blockSize is the target size of a table block
+const blockSize = uint64(4096)
+
+const (
+	blockKind           = uint64(1)
+	indexKind           = uint64(2)
+	headerKind          = uint64(4)
+	compressedBlockKind = uint64(5)
+)
+
+const tableHeaderSize = uint64(16)
+
+const trailerSize = uint64(40)
+
+// tableMagic marks the end of a complete table
+const tableMagic = uint64(0x73696d706c656462)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupt is returned when data read from a table is truncated or fails its
+// checksum.
+var ErrCorrupt = errors.New("simpledb: corrupt table")
+
+// A BlockHandle locates a block within a table.
+type BlockHandle struct {
+	// FirstKey is the smallest key in the block
+	FirstKey []byte
+	Offset   uint64
+	Length   uint64
+}
+
+// encodeTableFooter encodes the filter (if not nil), index and trailer of a
+// table, starting at offset filterOffset
+func encodeTableFooter(index []BlockHandle, filter bloomFilter,
+	filterOffset uint64) []byte {
+	var p []byte
+	if filter != nil {
+		p = encodeFilter(filter)
+	}
+	indexOffset := filterOffset + uint64(len(p))
+	var handles []byte
+	for _, h := range index {
+		handles = EncodeSlice(h.FirstKey, handles)
+		handles = EncodeUInt64(h.Offset, handles)
+		handles = EncodeUInt64(h.Length, handles)
+	}
+	p = EncodeUInt64(indexKind, p)
+	p = EncodeSlice(handles, p)
+	p = EncodeUInt64(filterOffset, p)
+	p = EncodeUInt64(indexOffset, p)
+	p = EncodeUInt64(uint64(len(index)), p)
+	p = EncodeUInt64(uint64(crc32.Checksum(handles, castagnoli)), p)
+	p = EncodeUInt64(tableMagic, p)
+	return p
+}
+
+func encodeTableHeader(codec Compression) []byte {
+	p := EncodeUInt64(headerKind, nil)
+	p = EncodeUInt64(uint64(codec), p)
+	return p
+}
+
+// readTableHeader reads the codec from a table's header.
+//
+// Returns false if the header is missing or names an unknown codec.
+func readTableHeader(d dbDir, f filesys.File) (Compression, bool, error) {
+	p, err := fsReadAt(d, f, 0, tableHeaderSize)
+	if err != nil {
+		return NoCompression, false, err
+	}
+	kind, l1 := DecodeUInt64(p)
+	codec, l2 := DecodeUInt64(p[l1:])
+	if l1 == 0 || l2 == 0 || kind != headerKind ||
+		!validCompression(Compression(codec)) {
+		return NoCompression, false, nil
+	}
+	return Compression(codec), true, nil
+}
+
+// encodeBlock frames the encoded entries of a block, compressing them with
+// codec if that saves enough space
+func encodeBlock(codec Compression, entries []byte) []byte {
+	kind := blockKind
+	if codec != NoCompression {
+		compressed := compressBlock(codec, entries)
+		if len(compressed) < len(entries)-len(entries)/8 {
+			kind = compressedBlockKind
+			entries = compressed
+		}
+	}
+	p := EncodeUInt64(kind, nil)
+	p = EncodeUInt64(uint64(crc32.Checksum(entries, castagnoli)), p)
+	p = EncodeSlice(entries, p)
+	return p
+}
+
+// decodeBlockFrame is a Decoder for a block, returning its kind and its
+// contents as stored.
+//
+// Fails if the block is truncated or its checksum doesn't match.
+func decodeBlockFrame(data []byte) (uint64, []byte, uint64) {
+	kind, l1 := DecodeUInt64(data)
+	if l1 == 0 || (kind != blockKind && kind != compressedBlockKind) {
+		return 0, nil, 0
+	}
+	checksum, l2 := DecodeUInt64(data[l1:])
+	if l2 == 0 {
+		return 0, nil, 0
+	}
+	contents, l3 := decodeSlice(data[l1+l2:])
+	if l3 == 0 {
+		return 0, nil, 0
+	}
+	if uint64(crc32.Checksum(contents, castagnoli)) != checksum {
+		return 0, nil, 0
+	}
+	return kind, contents, l1 + l2 + l3
+}
+
+// decodeRegion is a Decoder for a block or index with the given kind,
+// returning its contents
+func decodeRegion(kind uint64, data []byte) ([]byte, uint64) {
+	k, l1 := DecodeUInt64(data)
+	if l1 == 0 || k != kind {
+		return nil, 0
+	}
+	contents, l2 := decodeSlice(data[l1:])
+	if l2 == 0 {
+		return nil, 0
+	}
+	return contents, l1 + l2
+}
+
+// decodeBlockHandle is a Decoder(BlockHandle)
+func decodeBlockHandle(data []byte) (BlockHandle, uint64) {
+	firstKey, l1 := decodeSlice(data)
+	if l1 == 0 {
+		return BlockHandle{}, 0
+	}
+	off, l2 := DecodeUInt64(data[l1:])
+	if l2 == 0 {
+		return BlockHandle{}, 0
+	}
+	length, l3 := DecodeUInt64(data[l1+l2:])
+	if l3 == 0 {
+		return BlockHandle{}, 0
+	}
+	return BlockHandle{FirstKey: firstKey, Offset: off, Length: length},
+		l1 + l2 + l3
+}
+
+// decodeSlice is a Decoder([]byte)
+func decodeSlice(data []byte) ([]byte, uint64) {
+	n, l := DecodeUInt64(data)
+	if l == 0 {
+		return nil, 0
+	}
+	if uint64(len(data))-l < n {
+		return nil, 0
+	}
+	return data[l : l+n], l + n
+}
+
+// fileSize finds the length of f.
+//
+// filesys has no stat, so this probes for the end of the file, using a
+// logarithmic number of reads.
+func fileSize(d dbDir, f filesys.File) (size uint64, err error) {
+	defer catchFsError("read", "", &err)
+	hi := uint64(4096)
+	for len(d.fs.ReadAt(f, hi, 1)) > 0 {
+		hi = hi * 2
+	}
+	// the file ends in [0, hi]
+	lo := uint64(0)
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if len(d.fs.ReadAt(f, mid, 1)) > 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// readTableIndex loads the block index and filter from a table's footer.
+//
+// Returns false if the footer is missing or corrupt.
+func readTableIndex(d dbDir, f filesys.File) ([]BlockHandle, bloomFilter,
+	bool, error) {
+	size, err := fileSize(d, f)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if size < trailerSize {
+		return nil, nil, false, nil
+	}
+	trailer, err := fsReadAt(d, f, size-trailerSize, trailerSize)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	filterOffset, _ := DecodeUInt64(trailer)
+	indexOffset, _ := DecodeUInt64(trailer[8:])
+	numBlocks, _ := DecodeUInt64(trailer[16:])
+	checksum, _ := DecodeUInt64(trailer[24:])
+	magic, _ := DecodeUInt64(trailer[32:])
+	if magic != tableMagic || indexOffset > size-trailerSize ||
+		filterOffset > indexOffset {
+		return nil, nil, false, nil
+	}
+	p, err := fsReadAt(d, f, filterOffset, size-trailerSize-filterOffset)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	var filter bloomFilter
+	if filterOffset < indexOffset {
+		decoded, l := decodeFilter(p)
+		if l != indexOffset-filterOffset {
+			return nil, nil, false, nil
+		}
+		filter = decoded
+	}
+	handles, l := decodeRegion(indexKind, p[indexOffset-filterOffset:])
+	if l == 0 ||
+		uint64(crc32.Checksum(handles, castagnoli)) != checksum {
+		return nil, nil, false, nil
+	}
+	// the trailer isn't checksummed, so numBlocks has to agree with the
+	// handles (each at least 24 bytes) before it sizes anything
+	if numBlocks > uint64(len(handles))/24 {
+		return nil, nil, false, nil
+	}
+	index := make([]BlockHandle, 0, numBlocks)
+	for i := uint64(0); i < numBlocks; i++ {
+		h, l := decodeBlockHandle(handles)
+		if l == 0 {
+			return nil, nil, false, nil
+		}
+		index = append(index, h)
+		handles = handles[l:]
+	}
+	if len(handles) != 0 {
+		return nil, nil, false, nil
+	}
+	return index, filter, true, nil
+}
+
+// scanTableIndex rebuilds the block index of a table by walking its blocks
+// (compressed with codec) from the header on, up to the first region that
+// isn't a block.
+//
+// The filter isn't recovered, so the table is read without one.
+func scanTableIndex(d dbDir, f filesys.File,
+	codec Compression) ([]BlockHandle, error) {
+	size, err := fileSize(d, f)
+	if err != nil {
+		return nil, err
+	}
+	var index []BlockHandle
+	for off := tableHeaderSize; ; {
+		header, err := fsReadAt(d, f, off, 24)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(header)) < 24 {
+			break
+		}
+		kind, _ := DecodeUInt64(header)
+		length, _ := DecodeUInt64(header[16:])
+		if kind != blockKind && kind != compressedBlockKind {
+			break
+		}
+		// a damaged length can point past the end of the file; the block
+		// is then truncated, and the last one
+		truncated := length > size-off-24
+		n := length
+		if truncated {
+			n = size - off - 24
+		}
+		// read the first entry for its key
+		p, err := fsReadAt(d, f, off+24, n)
+		if err != nil {
+			return nil, err
+		}
+		if kind == compressedBlockKind {
+			p, err = decompressBlock(codec, p)
+			if err != nil {
+				break
+			}
+		}
+		e, l := DecodeEntry(p)
+		if l == 0 {
+			break
+		}
+		index = append(index, BlockHandle{
+			FirstKey: e.Key,
+			Offset:   off,
+			Length:   24 + n,
+		})
+		if truncated {
+			break
+		}
+		off = off + 24 + length
+	}
+	return index, nil
+}
+
+// findBlock returns the block that would contain k
+func findBlock(index []BlockHandle, k []byte) (int, bool) {
+	// find the first block that starts after k
+	b := sort.Search(len(index), func(i int) bool {
+		return bytes.Compare(index[i].FirstKey, k) > 0
+	})
+	if b == 0 {
+		return 0, false
+	}
+	return b - 1, true
+}
+
+func decodeBlock(p []byte) []Entry {
+	var entries []Entry
+	for {
+		e, l := DecodeEntry(p)
+		if l == 0 {
+			break
+		}
+		entries = append(entries, e)
+		p = p[l:]
+	}
+	return entries
+}
+
+// readBlockData reads and checks the encoded entries of a block of t,
+// decompressing them if needed
+func readBlockData(t Table, h BlockHandle) ([]byte, error) {
+	p, err := fsReadAt(t.dir, t.File, h.Offset, h.Length)
+	if err != nil {
+		return nil, err
+	}
+	kind, data, l := decodeBlockFrame(p)
+	if l != h.Length {
+		return nil, ErrCorrupt
+	}
+	if kind == compressedBlockKind {
+		return decompressBlock(t.codec, data)
+	}
+	return data, nil
+}
+
+func readBlock(t Table, h BlockHandle) ([]Entry, error) {
+	data, err := readBlockData(t, h)
+	if err != nil {
+		return nil, err
+	}
+	entries := decodeBlock(data)
+	if len(entries) == 0 || !bytes.Equal(entries[0].Key, h.FirstKey) {
+		return nil, ErrCorrupt
+	}
+	return entries, nil
+}
+
+// blockRead finds the version of k visible at seq in the (sorted) encoded
+// entries of a block
+func blockRead(p []byte, k []byte, seq uint64) (Entry, bool) {
+	for {
+		e, l := DecodeEntry(p)
+		if l == 0 {
+			return Entry{}, false
+		}
+		c := bytes.Compare(e.Key, k)
+		if c > 0 {
+			return Entry{}, false
+		}
+		if c == 0 && e.Seq <= seq {
+			return e, true
+		}
+		p = p[l:]
+	}
+}
+
+func sortedKeys(buf map[string][]version) []string {
+	keys := make([]string, 0, len(buf))
+	for k := range buf {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A tableIter scans a table in order, reading one block at a time.
+//
+// An error reading a block (a filesystem failure or ErrCorrupt) ends the scan,
+// and is reported by tableIterErr.
+type tableIter struct {
+	t Table
+	// the current block and its entries
+	block   int
+	entries []Entry
+	i       int
+	err     error
+}
+
+func newTableIter(t Table) *tableIter {
+	return &tableIter{t: t, block: len(t.Index), entries: nil, i: 0, err: nil}
+}
+
+func tableIterLoad(it *tableIter, b int) {
+	it.block = b
+	it.i = 0
+	it.entries = nil
+	if b < len(it.t.Index) && it.err == nil {
+		entries, err := readBlock(it.t, it.t.Index[b])
+		it.entries = entries
+		it.err = err
+	}
+}
+
+// tableIterSeek positions it at the first key >= k
+func tableIterSeek(it *tableIter, k []byte) {
+	b, ok := findBlock(it.t.Index, k)
+	if !ok {
+		// k is before the first block
+		b = 0
+	}
+	tableIterLoad(it, b)
+	it.i = sort.Search(len(it.entries), func(i int) bool {
+		return bytes.Compare(it.entries[i].Key, k) >= 0
+	})
+	if it.i == len(it.entries) {
+		tableIterLoad(it, b+1)
+	}
+}
+
+func tableIterValid(it *tableIter) bool {
+	return it.i < len(it.entries)
+}
+
+func tableIterEntry(it *tableIter) Entry {
+	return it.entries[it.i]
+}
+
+func tableIterNext(it *tableIter) {
+	it.i = it.i + 1
+	if it.i == len(it.entries) && it.block < len(it.t.Index) {
+		tableIterLoad(it, it.block+1)
+	}
+}
+
+func tableIterErr(it *tableIter) error {
+	return it.err
+}
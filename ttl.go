@@ -0,0 +1,97 @@
+package simpledb
+
+import (
+	"time"
+)
+
+// A write with a time-to-live expires at a fixed time, after which reads
+// treat the key as deleted.
+//
+// The expiry is stored with the version (and in the log and table entries)
+// as a Unix time in nanoseconds, where 0 means the version never expires.
+// Reads compare it against the database's clock (Options.Clock), and
+// compaction turns expired versions into deletions, so they are dropped from
+// the new table like any other deleted key.
+//
+// A merge operand records when it was written. If the value below it had
+// already expired by then, the operand applies to no value, as it would once
+// compaction drops the expired value; otherwise the value it produces expires
+// along with the one it applied to. Either way the result doesn't depend on
+// when a read resolves the operand or a compaction folds it.
+//
+// For that to hold, compaction can't drop an expired value that a buffered
+// operand written before the value expired still applies to, and neither can
+// it drop a value that an open snapshot, which reads as of the time it was
+// taken (see snapshot.go), still sees. So it expires versions as of
+// compactionTime rather than the current time.
+
+// expired reports whether a version that expires at expires (0 if never) has
+// expired at time now.
+func expired(expires uint64, now uint64) bool {
+	return expires != 0 && expires <= now
+}
+
+// optionsClock is opts.Clock, or time.Now if it isn't set
+func optionsClock(opts Options) func() time.Time {
+	if opts.Clock == nil {
+		return time.Now
+	}
+	return opts.Clock
+}
+
+// clockNow reads db's clock, as a Unix time in nanoseconds.
+func clockNow(db *Database) uint64 {
+	return uint64(db.clock().UnixNano())
+}
+
+// compactionTime is the time compaction expires versions at: the current time,
+// or the time the oldest open snapshot was taken or the oldest buffered merge
+// operand was written if that is earlier.
+//
+// Assumes bufferL is held.
+func compactionTime(db *Database) uint64 {
+	t := clockNow(db)
+	for _, snapTime := range db.snapshotTimes {
+		if snapTime < t {
+			t = snapTime
+		}
+	}
+	for _, buf := range []map[string][]version{*db.wbuffer, *db.rbuffer} {
+		for _, versions := range buf {
+			for _, v := range versions {
+				if v.merge && v.written < t {
+					t = v.written
+				}
+			}
+		}
+	}
+	return t
+}
+
+// expireVersions replaces the versions that have expired at time now with
+// deletions.
+func expireVersions(versions []version, now uint64) []version {
+	live := make([]version, len(versions))
+	for i, v := range versions {
+		if expired(v.expires, now) {
+			v = version{seq: v.seq, value: nil, merge: false, expires: 0}
+		}
+		live[i] = v
+	}
+	return live
+}
+
+// WriteWithTTL sets k to v, like Write, but only for ttl: afterward k reads
+// as missing, and the next compaction drops it. A ttl that isn't positive
+// writes a value that has already expired.
+func WriteWithTTL(db *Database, k []byte, v []byte, ttl time.Duration) error {
+	if v == nil {
+		// nil is reserved for tombstones
+		v = make([]byte, 0)
+	}
+	return bufferedWrite(db, func() (uint64, bool, error) {
+		expires := uint64(db.clock().Add(ttl).UnixNano())
+		v := version{value: v, expires: expires}
+		return writeLocked(db, k, v), true, nil
+	})
+}
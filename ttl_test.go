@@ -0,0 +1,236 @@
+package simpledb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a fakeClock only moves when the test advances it
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func ttlOptions(c *fakeClock) Options {
+	opts := mergeOptions()
+	opts.Clock = c.Now
+	return opts
+}
+
+func TestEntryEncodingExpires(t *testing.T) {
+	assert := assert.New(t)
+	e := Entry{Key: []byte("key"), Seq: 3, Value: []byte("value"), Expires: 7}
+	buf := EncodeEntry(e, nil)
+
+	decoded, l := DecodeEntry(buf)
+	assert.Equal(uint64(len(buf)), l)
+	assert.Equal(e, decoded)
+	_, l = DecodeEntry(buf[:20])
+	assert.Equal(uint64(0), l)
+}
+
+func (suite *SimpleDbSuite) TestWriteWithTTL() {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	db := mustDb(NewDbWithOptions(ttlOptions(c)))
+	suite.NoError(WriteWithTTL(db, key(1), []byte("v1"), 10*time.Second))
+	suite.NoError(Write(db, key(2), []byte("v2")))
+	suite.NoError(WriteWithTTL(db, key(3), []byte("v3"), 0))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(missing, dbRead(db, key(3)))
+	c.Advance(10 * time.Second)
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.Equal(present("v2"), dbRead(db, key(2)))
+	suite.NoError(Write(db, key(1), []byte("v1 again")))
+	suite.Equal(present("v1 again"), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestTTLInTable() {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	db := mustDb(NewDbWithOptions(ttlOptions(c)))
+	suite.NoError(WriteWithTTL(db, key(1), []byte("v1"), time.Second))
+	suite.NoError(WriteWithTTL(db, key(2), []byte("v2"), time.Minute))
+	suite.NoError(Write(db, key(3), []byte("v3")))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	suite.Equal(3, suite.tableEntries(db))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	c.Advance(time.Second)
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.Equal(present("v2"), dbRead(db, key(2)))
+	suite.NoError(CompactAll(db))
+	suite.Equal(2, suite.tableEntries(db))
+	c.Advance(time.Minute)
+	suite.NoError(CompactAll(db))
+	suite.Equal(1, suite.tableEntries(db))
+	suite.Equal(present("v3"), dbRead(db, key(3)))
+}
+
+func (suite *SimpleDbSuite) TestTTLIterator() {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	db := mustDb(NewDbWithOptions(ttlOptions(c)))
+	suite.NoError(WriteWithTTL(db, key(1), []byte("table 1"), time.Second))
+	suite.NoError(Write(db, key(2), []byte("table 2")))
+	suite.NoError(Compact(db))
+	suite.NoError(WriteWithTTL(db, key(3), []byte("buf 3"), time.Second))
+	suite.NoError(Write(db, key(4), []byte("buf 4")))
+	c.Advance(time.Second)
+	it := NewIterator(db, key(0), nil)
+	suite.Equal([]kv{
+		{k: key(2), v: "table 2"},
+		{k: key(4), v: "buf 4"},
+	}, iterAll(it))
+	suite.NoError(it.Close())
+}
+
+func (suite *SimpleDbSuite) TestTTLMerge() {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	db := mustDb(NewDbWithOptions(ttlOptions(c)))
+	suite.NoError(WriteWithTTL(db, key(1), []byte("a"), time.Second))
+	suite.NoError(Merge(db, key(1), []byte("b")))
+	suite.NoError(WriteWithTTL(db, key(2), []byte("x"), time.Second))
+	suite.NoError(Compact(db))
+	suite.NoError(Merge(db, key(2), []byte("y")))
+	suite.Equal(present("ab"), dbRead(db, key(1)))
+	suite.Equal(present("xy"), dbRead(db, key(2)))
+	// the operands expire with the values they apply to, whether or not a
+	// compaction has folded them in
+	c.Advance(time.Second)
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.Equal(missing, dbRead(db, key(2)))
+	suite.NoError(Compact(db))
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.Equal(missing, dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestTTLMergeCompactions() {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	read := func(compact func(db *Database) error) maybeValue {
+		suite.SetupTest()
+		db := mustDb(NewDbWithOptions(ttlOptions(c)))
+		suite.NoError(WriteWithTTL(db, key(1), []byte("base"), 2*time.Second))
+		suite.NoError(Merge(db, key(1), []byte("+op")))
+		c.Advance(3 * time.Second)
+		suite.NoError(compact(db))
+		v := dbRead(db, key(1))
+		suite.NoError(Shutdown(db))
+		return v
+	}
+	noCompaction := func(db *Database) error { return nil }
+	suite.Equal(missing, read(noCompaction))
+	suite.Equal(missing, read(Compact))
+	suite.Equal(missing, read(CompactAll))
+}
+
+func (suite *SimpleDbSuite) TestMergeKeepsExpiredBase() {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	db := mustDb(NewDbWithOptions(ttlOptions(c)))
+	suite.NoError(WriteWithTTL(db, key(1), []byte("a"), time.Second))
+	suite.NoError(Compact(db))
+	suite.NoError(Merge(db, key(1), []byte("b")))
+	c.Advance(time.Second)
+	// a level merge can't drop the value the buffered operand applies to
+	db.mergeL.Lock()
+	suite.NoError(mergeTables(db, (*db.levels)[0], 1))
+	db.mergeL.Unlock()
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.NoError(Compact(db))
+	suite.Equal(missing, dbRead(db, key(1)))
+	// once the operand is folded, the value can go
+	suite.NoError(CompactAll(db))
+	suite.Equal(0, suite.tableEntries(db))
+}
+
+func (suite *SimpleDbSuite) TestMergeAfterExpiry() {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	db := mustDb(NewDbWithOptions(ttlOptions(c)))
+	suite.NoError(WriteWithTTL(db, key(1), []byte("a"), time.Second))
+	c.Advance(time.Second)
+	// the table drops the expired value, but the read buffer keeps it
+	suite.NoError(Compact(db))
+	suite.NoError(Merge(db, key(1), []byte("b")))
+	suite.Equal(present("b"), dbRead(db, key(1)))
+	suite.NoError(Compact(db))
+	suite.Equal(present("b"), dbRead(db, key(1)))
+	suite.NoError(CompactAll(db))
+	suite.Equal(present("b"), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestNilClock() {
+	opts := DefaultOptions()
+	opts.Clock = nil
+	db := mustDb(NewDbWithOptions(opts))
+	suite.NoError(WriteWithTTL(db, key(1), []byte("v1"), time.Minute))
+	suite.NoError(WriteWithTTL(db, key(2), []byte("v2"), 0))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	suite.Equal(missing, dbRead(db, key(2)))
+	suite.NoError(Shutdown(db))
+	db = mustDb(RecoverWithOptions(opts))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestRecoverTTL() {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	db := mustDb(NewDbWithOptions(ttlOptions(c)))
+	suite.NoError(WriteWithTTL(db, key(1), []byte("v1"), time.Second))
+	suite.NoError(WriteWithTTL(db, key(2), []byte("v2"), time.Minute))
+	db = mustDb(RecoverWithOptions(ttlOptions(c)))
+	suite.Equal(present("v1"), dbRead(db, key(1)))
+	c.Advance(time.Second)
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.Equal(present("v2"), dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestRecoverTTLMerge() {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	db := mustDb(NewDbWithOptions(ttlOptions(c)))
+	suite.NoError(WriteWithTTL(db, key(1), []byte("a"), time.Second))
+	c.Advance(time.Second)
+	suite.NoError(Merge(db, key(1), []byte("b")))
+	suite.Equal(present("b"), dbRead(db, key(1)))
+	db = mustDb(RecoverWithOptions(ttlOptions(c)))
+	suite.Equal(present("b"), dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestTTLSnapshot() {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	db := mustDb(NewDbWithOptions(ttlOptions(c)))
+	suite.NoError(WriteWithTTL(db, key(1), []byte("v1"), time.Second))
+	suite.NoError(WriteWithTTL(db, key(2), []byte("v2"), time.Second))
+	s := Snapshot(db)
+	txn := Begin(db)
+	v, ok, err := txn.Get(key(1))
+	suite.NoError(err)
+	suite.True(ok)
+	suite.Equal([]byte("v1"), v)
+
+	// the snapshot keeps reading as of the time it was taken, even across
+	// compactions
+	c.Advance(time.Second)
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.NoError(CompactAll(db))
+	v, ok, err = txn.Get(key(2))
+	suite.NoError(err)
+	suite.True(ok)
+	suite.Equal([]byte("v2"), v)
+	suite.NoError(txn.Commit())
+	suite.Equal(present("v1"), suite.snapRead(s, key(1)))
+	it := s.NewIterator(key(0), nil)
+	suite.Equal([]kv{
+		{k: key(1), v: "v1"},
+		{k: key(2), v: "v2"},
+	}, iterAll(it))
+	suite.NoError(it.Close())
+	suite.NoError(s.Close())
+
+	suite.NoError(CompactAll(db))
+	suite.Equal(0, suite.tableEntries(db))
+}
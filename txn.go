@@ -0,0 +1,151 @@
+package simpledb
+
+import (
+	"errors"
+)
+
+// Transactions are optimistic: a transaction reads from a snapshot taken by
+// Begin and buffers its writes, without holding any locks. Commit then takes
+// bufferL, checks that none of the keys the transaction read has been written
+// since the snapshot, and applies the writes as one batch (see applyRecords).
+//
+// The check compares the sequence number of the newest version of each key
+// read against the snapshot's. The snapshot also keeps the versions it sees
+// from being compacted away, so a write after Begin can't be mistaken for one
+// before it.
+
+// ErrConflict is returned by Commit when another write changed a key the
+// transaction read.
+var ErrConflict = errors.New("simpledb: transaction conflict")
+
+// ErrTxnDone is returned by Commit on a transaction that already finished.
+var ErrTxnDone = errors.New("simpledb: transaction already finished")
+
+// A Txn is a read-write transaction, started with Begin.
+//
+// A Txn is not safe for concurrent use. It must be finished with Commit or
+// Rollback.
+type Txn struct {
+	snap *DbSnapshot
+	// the keys read
+	reads map[string]bool
+	// the writes to commit, and the latest one of each key (nil for a
+	// delete) so the transaction reads its own writes
+	batch  WriteBatch
+	writes map[string][]byte
+	done   bool
+}
+
+// Begin starts a transaction on db, which sees the writes completed so far.
+func Begin(db *Database) *Txn {
+	return &Txn{
+		snap:   Snapshot(db),
+		reads:  make(map[string]bool),
+		writes: make(map[string][]byte),
+		done:   false,
+	}
+}
+
+// Get reads k as of the start of the transaction, reflecting the
+// transaction's own writes. Errors are as for Read.
+func (txn *Txn) Get(k []byte) ([]byte, bool, error) {
+	v, ok := txn.writes[string(k)]
+	if ok {
+		return v, v != nil, nil
+	}
+	txn.reads[string(k)] = true
+	return txn.snap.Read(k)
+}
+
+// Put sets k to v when the transaction commits.
+func (txn *Txn) Put(k []byte, v []byte) {
+	txn.batch.Put(k, v)
+	// share the batch's copy of v
+	txn.writes[string(k)] = txn.batch.records[len(txn.batch.records)-1].Value
+}
+
+// Delete removes k when the transaction commits.
+func (txn *Txn) Delete(k []byte) {
+	txn.batch.Delete(k)
+	txn.writes[string(k)] = nil
+}
+
+// lastWriteSeq returns the sequence number of the newest version of k, or 0
+// if there is none.
+//
+// Assumes bufferL is held.
+func lastWriteSeq(db *Database, k []byte) (uint64, error) {
+	versions := (*db.wbuffer)[string(k)]
+	if len(versions) > 0 {
+		return versions[len(versions)-1].seq, nil
+	}
+	versions = (*db.rbuffer)[string(k)]
+	if len(versions) > 0 {
+		return versions[len(versions)-1].seq, nil
+	}
+	e, ok, err := tablesReadEntry(db, k, latestSeq)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return e.Seq, nil
+}
+
+// Commit applies the transaction's writes atomically, as Apply does, unless
+// another write changed a key the transaction read since Begin, in which case
+// it returns ErrConflict and applies nothing.
+//
+// Either way the transaction is finished. Other errors are as for Write.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+	db := txn.snap.db
+	if txn.batch.Len() == 0 {
+		db.bufferL.Lock()
+		err := txn.checkReads()
+		db.bufferL.Unlock()
+		err2 := txn.snap.Close()
+		if err != nil {
+			return err
+		}
+		return err2
+	}
+	err := bufferedWrite(db, func() (uint64, bool, error) {
+		err := txn.checkReads()
+		if err != nil {
+			return 0, false, err
+		}
+		return applyRecords(db, txn.batch.records), true, nil
+	})
+	txn.snap.Close()
+	return err
+}
+
+// checkReads returns ErrConflict if a key the transaction read has been
+// written since its snapshot.
+//
+// Assumes bufferL is held.
+func (txn *Txn) checkReads() error {
+	db := txn.snap.db
+	for k := range txn.reads {
+		seq, err := lastWriteSeq(db, []byte(k))
+		if err != nil {
+			return err
+		}
+		if seq > txn.snap.seq {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// Rollback abandons the transaction, discarding its writes. It has no effect
+// on a finished transaction.
+func (txn *Txn) Rollback() {
+	if txn.done {
+		return
+	}
+	txn.done = true
+	txn.snap.Close()
+}
@@ -0,0 +1,125 @@
+package simpledb
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+func (suite *SimpleDbSuite) txnGet(txn *Txn, k []byte) maybeValue {
+	v, ok, err := txn.Get(k)
+	suite.Require().NoError(err)
+	return maybeValue{value: v, present: ok}
+}
+
+func (suite *SimpleDbSuite) TestTxnCommit() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Write(db, key(2), []byte("v2")))
+	txn := Begin(db)
+	suite.Equal(present("v1"), suite.txnGet(txn, key(1)))
+	txn.Put(key(1), []byte("txn 1"))
+	txn.Delete(key(2))
+	txn.Put(key(3), []byte("txn 3"))
+	suite.Equal(present("txn 1"), suite.txnGet(txn, key(1)),
+		"should read own writes")
+	suite.Equal(missing, suite.txnGet(txn, key(2)))
+	suite.Equal(present("v1"), dbRead(db, key(1)),
+		"writes should not be visible before commit")
+	suite.NoError(txn.Commit())
+	suite.Equal(ErrTxnDone, txn.Commit())
+	suite.Equal(present("txn 1"), dbRead(db, key(1)))
+	suite.Equal(missing, dbRead(db, key(2)))
+	suite.Equal(present("txn 3"), dbRead(db, key(3)))
+	suite.Equal(0, len(db.snapshots))
+
+	db = mustDb(Recover())
+	suite.Equal(present("txn 1"), dbRead(db, key(1)))
+	suite.Equal(missing, dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestTxnConflict() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	txn := Begin(db)
+	suite.Equal(present("v1"), suite.txnGet(txn, key(1)))
+	suite.Equal(missing, suite.txnGet(txn, key(2)))
+	txn.Put(key(3), []byte("txn 3"))
+	suite.NoError(Write(db, key(2), []byte("v2")))
+	suite.Equal(missing, suite.txnGet(txn, key(2)),
+		"should read from the start of the transaction")
+	suite.Equal(ErrConflict, txn.Commit())
+	suite.Equal(missing, dbRead(db, key(3)))
+	suite.Equal(0, len(db.snapshots))
+}
+
+func (suite *SimpleDbSuite) TestTxnNoConflict() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	txn := Begin(db)
+	suite.Equal(present("v1"), suite.txnGet(txn, key(1)))
+	// blind writes don't conflict
+	txn.Put(key(2), []byte("txn 2"))
+	suite.NoError(Write(db, key(2), []byte("v2")))
+	suite.NoError(Write(db, key(3), []byte("v3")))
+	suite.NoError(txn.Commit())
+	suite.Equal(present("txn 2"), dbRead(db, key(2)))
+}
+
+func (suite *SimpleDbSuite) TestTxnConflictAfterCompaction() {
+	db := mustDb(NewDb())
+	suite.NoError(Write(db, key(1), []byte("v1")))
+	suite.NoError(Compact(db))
+	txn := Begin(db)
+	suite.Equal(present("v1"), suite.txnGet(txn, key(1)))
+	suite.NoError(Delete(db, key(1)))
+	suite.NoError(Compact(db))
+	suite.NoError(Compact(db))
+	db.bufferL.Lock()
+	shrinkReadBuffer(db, 0)
+	db.bufferL.Unlock()
+	// the deletion is only in the table, which keeps it for the transaction
+	suite.Equal(present("v1"), suite.txnGet(txn, key(1)))
+	txn.Put(key(1), []byte("txn 1"))
+	suite.Equal(ErrConflict, txn.Commit())
+	suite.Equal(missing, dbRead(db, key(1)))
+}
+
+func (suite *SimpleDbSuite) TestTxnRollback() {
+	db := mustDb(NewDb())
+	txn := Begin(db)
+	txn.Put(key(1), []byte("v1"))
+	txn.Rollback()
+	txn.Rollback()
+	suite.Equal(ErrTxnDone, txn.Commit())
+	suite.Equal(missing, dbRead(db, key(1)))
+	suite.Equal(0, len(db.snapshots))
+}
+
+func (suite *SimpleDbSuite) TestTxnCounter() {
+	db := mustDb(NewDb())
+	var wg sync.WaitGroup
+	for tid := 0; tid < 4; tid++ {
+		wg.Add(1)
+		go func() {
+			for i := 0; i < 50; {
+				txn := Begin(db)
+				v, ok, err := txn.Get(key(0))
+				suite.NoError(err)
+				n := uint64(0)
+				if ok {
+					n = binary.BigEndian.Uint64(v)
+				}
+				txn.Put(key(0), key(n+1))
+				err = txn.Commit()
+				if err == ErrConflict {
+					continue
+				}
+				suite.NoError(err)
+				i++
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	suite.Equal(present(string(key(200))), dbRead(db, key(0)))
+}